@@ -0,0 +1,79 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+)
+
+// Consult reads a sequence of dot terminated Erlang terms, like Erlang file:consult/1,
+// as found in configuration files such as sys.config or rebar.config.
+// Terms are returned as by ParseTerm. Syntax errors are returned as a SyntaxError
+// giving the number of the invalid term and its position.
+func Consult(r io.Reader) ([]interface{}, error) {
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newParser(string(text))
+	terms := []interface{}{}
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return terms, nil
+		}
+		term, err := p.parseTerm()
+		if err == nil {
+			err = p.expectEnd()
+		}
+		if err != nil {
+			if serr, ok := err.(*SyntaxError); ok {
+				serr.Term = len(terms) + 1
+			}
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+}
+
+// expectEnd reads the dot ending a term. It must be followed by white space,
+// a comment or the end of the text.
+func (p *parser) expectEnd() error {
+	if err := p.expect("."); err != nil {
+		return err
+	}
+	switch r := p.peek(); r {
+	case -1, ' ', '\t', '\n', '\r', '\f', '\v', '%':
+		return nil
+	}
+	return p.errorf("unexpected %s after end of term", p.describe())
+}
+
+// ConsultTo reads a sequence of dot terminated Erlang terms, like Consult, and decodes
+// them to the slice pointed to by terms. Each term is decoded to an element of the slice,
+// with the same rules as Decode, so that terms can be decoded to structs.
+func ConsultTo(r io.Reader, terms interface{}) error {
+	val := reflect.ValueOf(terms)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("cannot consult to %T: target must be a pointer to a slice", terms)
+	}
+	list, err := Consult(r)
+	if err != nil {
+		return err
+	}
+
+	slice := reflect.MakeSlice(val.Elem().Type(), len(list), len(list))
+	for i, term := range list {
+		data, err := Encode(term)
+		if err != nil {
+			return err
+		}
+		if err := UnmarshalWithOptions(data, slice.Index(i).Addr().Interface(), DecodeOptions{Limits: unlimited}); err != nil {
+			return fmt.Errorf("cannot decode term %d: %v", i+1, err)
+		}
+	}
+	val.Elem().Set(slice)
+	return nil
+}
@@ -0,0 +1,103 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+const rebarConfig = `%% Build configuration
+{erl_opts, [debug_info]}.
+{deps, [{cowboy, "2.9.0"}, % web server
+        {jsx, "3.1.0"}]}.
+
+% Trailing comment`
+
+func TestConsult(t *testing.T) {
+	terms, err := bertrpc.Consult(strings.NewReader(rebarConfig))
+	if err != nil {
+		t.Fatalf("cannot consult terms: %s", err)
+	}
+	expected := []interface{}{
+		bertrpc.T(bertrpc.A("erl_opts"), bertrpc.List{bertrpc.A("debug_info")}),
+		bertrpc.T(bertrpc.A("deps"), bertrpc.List{
+			bertrpc.T(bertrpc.A("cowboy"), bertrpc.List{int64('2'), int64('.'), int64('9'), int64('.'), int64('0')}),
+			bertrpc.T(bertrpc.A("jsx"), bertrpc.List{int64('3'), int64('.'), int64('1'), int64('.'), int64('0')}),
+		}),
+	}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("expected %v, actual %v", expected, terms)
+	}
+
+	terms, err = bertrpc.Consult(strings.NewReader("  % nothing\n"))
+	if err != nil || len(terms) != 0 {
+		t.Errorf("consulting only comments should return no terms: %v, %v", terms, err)
+	}
+}
+
+func TestConsultErrors(t *testing.T) {
+	var tests = []struct {
+		text   string
+		term   int
+		line   int
+		column int
+	}{
+		{"a.\n{b, c}", 2, 2, 7},
+		{"a.\nb.\n{c,\n X}.", 3, 4, 2},
+		{"a.b.", 1, 1, 3},
+		{"a. [}.", 2, 1, 5},
+	}
+
+	for _, tt := range tests {
+		_, err := bertrpc.Consult(strings.NewReader(tt.text))
+		serr, ok := err.(*bertrpc.SyntaxError)
+		if !ok {
+			t.Errorf("consulting %q should return a SyntaxError, got %v", tt.text, err)
+			continue
+		}
+		if serr.Term != tt.term || serr.Line != tt.line || serr.Column != tt.column {
+			t.Errorf("consulting %q: expected error in term %d at %d:%d, got %s", tt.text, tt.term, tt.line, tt.column, serr)
+		}
+	}
+}
+
+type dependency struct {
+	Name    string
+	Version string
+}
+
+type option struct {
+	Key   string
+	Value []interface{}
+}
+
+func TestConsultTo(t *testing.T) {
+	var deps []dependency
+	text := `{cowboy, "2.9.0"}. {jsx, <<"3.1.0">>}.`
+	if err := bertrpc.ConsultTo(strings.NewReader(text), &deps); err != nil {
+		t.Fatalf("cannot consult to structs: %s", err)
+	}
+	expected := []dependency{{"cowboy", "2.9.0"}, {"jsx", "3.1.0"}}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("expected %v, actual %v", expected, deps)
+	}
+
+	var opts []option
+	if err := bertrpc.ConsultTo(strings.NewReader(rebarConfig), &opts); err != nil {
+		t.Fatalf("cannot consult to structs: %s", err)
+	}
+	if len(opts) != 2 || opts[0].Key != "erl_opts" || opts[1].Key != "deps" || len(opts[1].Value) != 2 {
+		t.Errorf("unexpected options %v", opts)
+	}
+
+	if err := bertrpc.ConsultTo(strings.NewReader(text), deps); err == nil {
+		t.Errorf("consulting to a slice that is not a pointer should fail")
+	}
+	var numbers []int
+	err := bertrpc.ConsultTo(strings.NewReader("1. two. 3."), &numbers)
+	if err == nil || !strings.Contains(err.Error(), "term 2") {
+		t.Errorf("decoding error should report the term number, got %v", err)
+	}
+}
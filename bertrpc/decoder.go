@@ -1,50 +1,283 @@
 package bertrpc // import "gosrc.io/erlang/bertrpc"
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
+// ErrRange is the error wrapped by RangeError. Since decoded numbers out of range
+// are reported as a *RangeError, check for it with errors.Is(err, ErrRange)
+// rather than by comparing errors.
 var ErrRange = errors.New("value out of range")
 
+// RangeError is returned when a decoded number does not fit in its target type.
+type RangeError struct {
+	// Value is the decoded number, as text.
+	Value string
+	// Type is the type of the target.
+	Type reflect.Type
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("erlang number %s overflows %s", e.Value, e.Type)
+}
+
+// Unwrap returns ErrRange, so that range errors can be checked with errors.Is.
+func (e *RangeError) Unwrap() error {
+	return ErrRange
+}
+
+var (
+	rawTermType = reflect.TypeOf(RawTerm(nil))
+	mapTermType = reflect.TypeOf(Map(nil))
+)
+
+// DecodeOptions controls how terms are decoded.
+type DecodeOptions struct {
+	// BinaryAsString decodes binaries to string instead of []byte when the target
+	// is an empty interface, as is usually expected for Elixir strings.
+	BinaryAsString bool
+	// AliasBytes lets decoded binaries share memory with the input of Unmarshal instead
+	// of being copied. The input must then not be modified while the decoded values are in use.
+	AliasBytes bool
+	// Limits protects against untrusted input.
+	Limits DecodeLimits
+	// NilAtom is the atom decoded to nil pointers. It defaults to DefaultNilAtom.
+	// Use "nil" for Elixir.
+	NilAtom string
+}
+
+// decodeState holds the input of the term being decoded and the decoding options.
+// The term is read either from the reader r, or from memory, in data starting at off.
+// All reads from r are full reads, so that the reader can be a network stream returning
+// partial data.
+type decodeState struct {
+	r    io.Reader
+	data []byte
+	off  int
+	opts DecodeOptions
+	// bytes is the number of bytes read, and depth the current nesting depth,
+	// checked against the decoding limits.
+	bytes int64
+	depth int
+	// capture receives the bytes read from r while capturing a raw term.
+	capture []byte
+	// scratch receives fixed size fields, to avoid allocations.
+	scratch [8]byte
+}
+
+// Decode reads a single term from r and stores it in the value pointed to by term.
+// Decode may read past the end of the term: use a Decoder to read several terms
+// from the same stream.
 func Decode(r io.Reader, term interface{}) error {
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
-	if err != nil {
+	if err := checkTarget(term); err != nil {
+		return err
+	}
+	d := &decodeState{r: r}
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	return d.decodeData(term)
+}
+
+// Unmarshal decodes the term encoded in data and stores it in the value pointed to by term.
+// The term is parsed directly from memory, which is faster than Decode and allocates less.
+// Data following the term is ignored.
+func Unmarshal(data []byte, term interface{}) error {
+	return UnmarshalWithOptions(data, term, DecodeOptions{})
+}
+
+// UnmarshalWithOptions is like Unmarshal, using the given options.
+func UnmarshalWithOptions(data []byte, term interface{}, opts DecodeOptions) error {
+	if err := checkTarget(term); err != nil {
+		return err
+	}
+	d := &decodeState{data: data, opts: opts}
+	if err := d.readHeader(); err != nil {
 		return err
 	}
+	return d.decodeData(term)
+}
+
+// InvalidUnmarshalError is returned by Decode, Unmarshal, Decoder.Decode and DecodeReply
+// when the target is not a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "cannot decode to nil"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return fmt.Sprintf("cannot decode to non-pointer %s", e.Type)
+	}
+	return fmt.Sprintf("cannot decode to nil %s", e.Type)
+}
+
+// checkTarget checks that term is a non-nil pointer, so that the decoded term can be stored.
+func checkTarget(term interface{}) error {
+	if v := reflect.ValueOf(term); v.Kind() != reflect.Ptr || v.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(term)}
+	}
+	return nil
+}
 
-	// Read Erlang Term Format "magic byte"
-	if byte1[0] != byte(TagETFVersion) {
+// readHeader reads the Erlang Term Format "magic byte" and prepares the reader to use
+// to decode the term. Compressed terms are inflated.
+// io.EOF is returned as is if there is no term to read.
+func (d *decodeState) readHeader() error {
+	version := d.scratch[:1]
+	if err := d.read(version); err != nil {
+		return err
+	}
+	if version[0] != TagETFVersion {
 		// Bad Version tag (aka 'magic number')
-		return fmt.Errorf("incorrect Erlang Term version tag: %d", byte1[0])
+		return fmt.Errorf("incorrect Erlang Term version tag: %d", version[0])
+	}
+
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagCompressed {
+		// Put back the tag of the term
+		d.unread([]byte{byte(tag)})
+		return nil
+	}
+	return d.inflate()
+}
+
+// inflate decompresses a zlib compressed term, and checks it against its announced
+// uncompressed size. The term is then decoded from memory.
+func (d *decodeState) inflate() error {
+	size, err := d.readUint32()
+	if err != nil {
+		return err
+	}
+	if err := d.checkBytes(int64(size)); err != nil {
+		return err
 	}
 
-	return decodeData(r, term)
+	r := d.r
+	if r == nil {
+		r = bytes.NewReader(d.data[d.off:])
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("compressed term is smaller than its announced size %d", size)
+		}
+		return err
+	}
+	// Reading past the announced size must reach the end of the zlib stream.
+	// This also checks the zlib checksum.
+	if _, err := io.ReadFull(zr, make([]byte, 1)); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("compressed term is larger than its announced size %d", size)
+		}
+		return err
+	}
+	d.r, d.data, d.off = nil, data, 0
+	return nil
 }
 
-func decodeData(r io.Reader, term interface{}) error {
+func (d *decodeState) decodeData(term interface{}) error {
 	// Resolve pointers
 	val := reflect.ValueOf(term)
 	if val.Kind() == reflect.Ptr {
 		val = val.Elem()
 	}
+	if !val.IsValid() {
+		return fmt.Errorf("unhandled decoding target: %v", term)
+	}
+	// Raw terms are kept encoded
+	if val.Type() == rawTermType {
+		raw, err := d.rawTerm()
+		if err == nil {
+			val.SetBytes(raw)
+		}
+		return err
+	}
+	// Pointer targets, such as pointer fields, are set to nil by the nil atom,
+	// and allocated otherwise
+	if val.Kind() == reflect.Ptr {
+		isNil, err := d.decodeNilAtom()
+		if err != nil || isNil {
+			if isNil {
+				val.Set(reflect.Zero(val.Type()))
+			}
+			return err
+		}
+		if val.IsNil() {
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		return d.decodeData(val.Interface())
+	}
+
+	// Types can define how to decode their Erlang representation
+	if u, ok := unmarshaler(val); ok {
+		return d.decodeUnmarshaler(u)
+	}
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+
+	switch val.Type() {
+	case durationType:
+		return d.decodeDuration(val)
+	case timeType:
+		return fmt.Errorf("cannot decode time.Time without a time representation option")
+	}
 
 	switch val.Kind() {
 
-	case reflect.Int8:
-		return ErrRange
-	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := decodeInt(r)
+	case reflect.Bool:
+		b, err := d.decodeBool()
+		if err == nil {
+			val.SetBool(b)
+		}
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return d.decodeIntTo(val)
+	case reflect.Float32:
+		f, err := d.decodeFloat()
+		if err != nil {
+			return err
+		}
+		if math.Abs(f) > math.MaxFloat32 {
+			return &RangeError{Value: strconv.FormatFloat(f, 'g', -1, 64), Type: val.Type()}
+		}
+		val.SetFloat(f)
+		return nil
+	case reflect.Float64:
+		f, err := d.decodeFloat()
 		if err == nil {
-			val.SetInt(i)
+			val.SetFloat(f)
 		}
 		return err
 	case reflect.String:
-		s, err := decodeString(r)
+		s, err := d.decodeString()
 		if err == nil {
 			val.SetString(s)
 		}
@@ -52,9 +285,57 @@ func decodeData(r io.Reader, term interface{}) error {
 	case reflect.Struct:
 		// Wrapper for basic types
 		if val.Type().Name() == "String" {
-			return decodeBertString(r, val)
+			return d.decodeBertString(val)
+		}
+		switch v := val.Addr().Interface().(type) {
+		case *big.Int:
+			return d.decodeBigInt(v)
+		case *Pid:
+			return d.decodePid(v)
+		case *Port:
+			return d.decodePort(v)
+		case *Ref:
+			return d.decodeRef(v)
+		case *Export:
+			return d.decodeExport(v)
+		case *Fun:
+			return d.decodeFun(v)
+		case *BitString:
+			return d.decodeBitString(v)
+		case *ImproperList:
+			return d.decodeImproperList(v)
+		case *Tuple:
+			return d.decodeTuple(v)
+		}
+		return d.decodeStruct(val)
+	case reflect.Slice, reflect.Array:
+		// Generic maps can hold any key
+		if val.Type() == mapTermType {
+			return d.decodeMapTerm(val)
 		}
-		return decodeStruct(r, val)
+		return d.decodeList(val)
+	case reflect.Map:
+		return d.decodeMap(val)
+	case reflect.Interface:
+		// Pointers set in the interface, for example as Tuple or List elements,
+		// give the target type
+		if elem := val.Elem(); elem.Kind() == reflect.Ptr && !elem.IsNil() {
+			return d.decodeData(elem.Interface())
+		}
+		// Without a concrete target type, we decode the generic term tree
+		if val.NumMethod() != 0 {
+			return fmt.Errorf("cannot decode to non-empty interface %s", val.Type())
+		}
+		t, err := d.decodeTerm()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			val.Set(reflect.Zero(val.Type()))
+		} else {
+			val.Set(reflect.ValueOf(t))
+		}
+		return nil
 
 	default:
 		return fmt.Errorf("unhandled decoding target: %s", val.Kind())
@@ -64,180 +345,356 @@ func decodeData(r io.Reader, term interface{}) error {
 // ============================================================================
 // Decode basic types
 
-// TODO: Pass bitsize here to trigger overflow operations errors
-func decodeInt(r io.Reader) (int64, error) {
+// decodeNilAtom reads the next term if it is the nil atom, and reports whether it was.
+// Any other term is left to be decoded.
+func (d *decodeState) decodeNilAtom() (bool, error) {
+	tag, err := d.readTag()
+	if err != nil {
+		return false, err
+	}
+
+	read := []byte{byte(tag)}
+	var atom []byte
+	switch tag {
+	case TagSmallAtomUTF8:
+		if atom, err = d.decodeString1(); err != nil {
+			return false, err
+		}
+		read = append(read, byte(len(atom)))
+	case TagDeprecatedAtom, TagAtomUTF8:
+		if atom, err = d.decodeString2(); err != nil {
+			return false, err
+		}
+		read = append(read, byte(len(atom)>>8), byte(len(atom)))
+	}
+	if atom != nil && string(atom) == nilAtom(d.opts.NilAtom) {
+		return true, nil
+	}
+	d.unread(append(read, atom...))
+	return false, nil
+}
+
+// decodeBool decodes the atoms true and false.
+func (d *decodeState) decodeBool() (bool, error) {
+	atom, err := d.readAtom()
+	if err != nil {
+		return false, err
+	}
+	switch atom {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot decode atom %s to bool", atom)
+}
+
+// decodeIntTo decodes any Erlang integer to an integer value of any size,
+// checking that it fits in the value type.
+func (d *decodeState) decodeIntTo(val reflect.Value) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag == TagSmallBig || tag == TagLargeBig {
+		i, err := d.decodeBigIntBody(tag)
+		if err != nil {
+			return err
+		}
+		return setBigInt(val, i)
+	}
+
+	i, err := d.decodeIntBody(tag)
+	if err != nil {
+		return err
+	}
+	return setInt(val, i)
+}
+
+func (d *decodeState) decodeInt() (int64, error) {
 	// Read Tag
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	tag, err := d.readTag()
 	if err != nil {
 		return 0, err
 	}
+	return d.decodeIntBody(tag)
+}
 
+// decodeIntBody decodes an integer whose tag has already been read.
+func (d *decodeState) decodeIntBody(tag int) (int64, error) {
 	// Compare expected type
-	switch int(byte1[0]) {
+	switch tag {
 
 	case TagSmallInteger:
-		_, err = r.Read(byte1)
+		b, err := d.readByte()
 		if err != nil {
 			return 0, err
 		}
-		return int64(byte1[0]), nil
+		return int64(b), nil
 
 	case TagInteger:
-		byte4 := make([]byte, 4)
-		n, err := r.Read(byte4)
+		u, err := d.readUint32()
+		if err != nil {
+			return 0, err
+		}
+		return int64(int32(u)), nil
+
+	case TagSmallBig, TagLargeBig:
+		i, err := d.decodeBigIntBody(tag)
 		if err != nil {
 			return 0, err
 		}
-		if n < 4 {
-			return 0, fmt.Errorf("cannot decode integer, only %d bytes read", n)
+		if !i.IsInt64() {
+			return 0, &RangeError{Value: i.String(), Type: reflect.TypeOf(int64(0))}
 		}
-		var32 := int32(binary.BigEndian.Uint32(byte4))
-		return int64(var32), nil
+		return i.Int64(), nil
 	}
 
 	return 0, fmt.Errorf("incorrect type")
 }
 
+// decodeBigInt decodes any Erlang integer into a big.Int.
+func (d *decodeState) decodeBigInt(i *big.Int) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case TagSmallBig, TagLargeBig:
+		b, err := d.decodeBigIntBody(tag)
+		if err != nil {
+			return err
+		}
+		i.Set(b)
+		return nil
+	}
+
+	v, err := d.decodeIntBody(tag)
+	if err != nil {
+		return err
+	}
+	i.SetInt64(v)
+	return nil
+}
+
+// decodeBigIntBody decodes a SMALL_BIG_EXT or LARGE_BIG_EXT integer whose tag has
+// already been read.
+// Big integers are made of a digit count, a sign byte and the digits, stored as
+// bytes in little-endian order.
+func (d *decodeState) decodeBigIntBody(tag int) (*big.Int, error) {
+	var n int
+	switch tag {
+	case TagSmallBig:
+		b, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		n = int(b)
+	case TagLargeBig:
+		length, err := d.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		n = int(length)
+	default:
+		return nil, fmt.Errorf("cannot decode %s as big integer", tagName(tag))
+	}
+
+	// Sign and digits
+	data, err := d.view(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	// big.Int expects big-endian bytes
+	digits := make([]byte, n)
+	for i, b := range data[1:] {
+		digits[n-1-i] = b
+	}
+
+	i := new(big.Int).SetBytes(digits)
+	if data[0] != 0 {
+		i.Neg(i)
+	}
+	return i, nil
+}
+
+func (d *decodeState) decodeFloat() (float64, error) {
+	tag, err := d.readTag()
+	if err != nil {
+		return 0, err
+	}
+	return d.decodeFloatBody(tag)
+}
+
+// decodeFloatBody decodes a float whose tag has already been read.
+func (d *decodeState) decodeFloatBody(tag int) (float64, error) {
+	switch tag {
+
+	case TagNewFloat:
+		u, err := d.readUint64()
+		if err != nil {
+			return 0, err
+		}
+		f := math.Float64frombits(u)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot decode invalid float %v", f)
+		}
+		return f, nil
+
+	case TagFloat:
+		// Legacy format: float printed with "%.20e" in a 31 bytes string, padded with zeros
+		data, err := d.view(31)
+		if err != nil {
+			return 0, err
+		}
+		str := strings.TrimRight(string(data), "\x00")
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decode float %q: %v", str, err)
+		}
+		// Erlang has no NaN nor infinity, which ParseFloat accepts
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot decode invalid float %q", str)
+		}
+		return f, nil
+	}
+
+	return 0, fmt.Errorf("cannot decode %s as float", tagName(tag))
+}
+
 // We can decode several Erlang types in a string: Atom (Deprecated), AtomUTF8, Binary, CharList.
-func decodeString(r io.Reader) (string, error) {
+func (d *decodeState) decodeString() (string, error) {
 	// Read Tag
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	dataType, err := d.readTag()
 	if err != nil {
 		return "", err
 	}
 
 	// Compare expected type
-	dataType := int(byte1[0])
 	switch dataType {
 
 	case TagSmallAtomUTF8:
-		data, err := decodeString1(r)
+		data, err := d.decodeString1()
 		return string(data), err
 
-	case TagDeprecatedAtom, TagAtomUTF8, TagString:
-		data, err := decodeString2(r)
+	case TagDeprecatedAtom, TagAtomUTF8:
+		data, err := d.decodeString2()
 		return string(data), err
 
+	case TagString:
+		data, err := d.decodeString2()
+		return latin1String(data), err
+
 	case TagBinary:
-		data, err := decodeString4(r)
+		data, err := d.decodeString4()
 		return string(data), err
 
 	case TagList:
-		data, err := decodeCharList(r)
+		data, err := d.decodeCharList()
 		return string(data), err
+
+	case TagNil:
+		// Empty charlist
+		return "", nil
 	}
 
 	return "", fmt.Errorf("incorrect type: %d", dataType)
 }
 
-func decodeString1(r io.Reader) ([]byte, error) {
+// decodeString1, decodeString2 and decodeString4 read data prefixed by its length
+// on 8, 16 or 32 bits. The data can be a view of the input: it must be copied
+// with keep to be retained.
+func (d *decodeState) decodeString1() ([]byte, error) {
 	// Length:
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	length, err := d.readByte()
 	if err != nil {
 		return []byte{}, err
 	}
-	length := int(byte1[0])
 
 	// Content:
-	data := make([]byte, length)
-	n, err := r.Read(data)
-	if err != nil && err != io.EOF {
-		return []byte{}, err
-	}
-	if n < length {
-		return []byte{}, fmt.Errorf("truncated data")
-	}
-	return data, nil
-
+	return d.view(int(length))
 }
 
 // Decode a string with length on 16 bits.
-func decodeString2(r io.Reader) ([]byte, error) {
+func (d *decodeState) decodeString2() ([]byte, error) {
 	// Length:
-	l := make([]byte, 2)
-	_, err := r.Read(l)
+	length, err := d.readUint16()
 	if err != nil {
 		return []byte{}, err
 	}
-	length := int(binary.BigEndian.Uint16(l))
 
 	// Content:
-	data := make([]byte, length)
-	n, err := r.Read(data)
-	if err != nil && err != io.EOF {
-		return []byte{}, err
-	}
-	if n < length {
-		return []byte{}, fmt.Errorf("truncated data")
-	}
-
-	return data, nil
+	return d.view(int(length))
 }
 
 // Decode a string with length on 32 bits.
-func decodeString4(r io.Reader) ([]byte, error) {
+func (d *decodeState) decodeString4() ([]byte, error) {
 	// Length:
-	l := make([]byte, 4)
-	_, err := r.Read(l)
+	length, err := d.readUint32()
 	if err != nil {
 		return []byte{}, err
 	}
-	length := int(binary.BigEndian.Uint32(l))
-
-	// Content:
-	data := make([]byte, length)
-	n, err := r.Read(data)
-	if err != nil && err != io.EOF {
+	if err := d.checkBinarySize(length); err != nil {
 		return []byte{}, err
 	}
-	if n < length {
-		return []byte{}, fmt.Errorf("truncated data")
-	}
 
-	return data, nil
+	// Content:
+	return d.view(int(length))
 }
 
-// Decode a string with length on 32 bits.
-func decodeCharList(r io.Reader) ([]rune, error) {
+// latin1String converts the content of a STRING_EXT, where each byte is a character
+// code, to a UTF-8 string.
+func latin1String(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Decode a list of integers as a list of runes.
+func (d *decodeState) decodeCharList() ([]rune, error) {
 	// Count:
-	byte4 := make([]byte, 4)
-	n, err := r.Read(byte4)
+	count, err := d.readCount()
 	if err != nil {
 		return []rune{}, err
 	}
-	if n < 4 {
-		return []rune{}, fmt.Errorf("truncated List data")
-	}
-	count := int(binary.BigEndian.Uint32(byte4))
 
-	s := []rune("")
-	// Last element in list should be termination marker, so we loop (count - 1) times
-	for i := 1; i <= count; i++ {
+	s := make([]rune, 0, capacity(count, runeSize))
+	err = d.decodeListElts(count, func(int) error {
 		// Assumption: We are decoding a into a string, so we expect all elements to be integers;
 		// We can fail otherwise.
-		char, err := decodeInt(r)
+		char, err := d.decodeInt()
 		if err != nil {
-			return []rune{}, err
+			return err
 		}
 		// Erlang does not encode utf8 charlist into a series of bytes, but use large integers.
 		// We need to process the integer list as runes.
 		s = append(s, rune(char))
+		return nil
+	})
+	if err != nil {
+		return []rune{}, err
 	}
-	// Check that we have the list termination mark
-	if err := decodeNil(r); err != nil {
-		return s, err
-	}
-
 	return s, nil
 }
 
-func decodeBertString(r io.Reader, val reflect.Value) error {
+// decodeListElts calls decodeElt for each of the count elements of a list,
+// then checks that the list is properly terminated.
+func (d *decodeState) decodeListElts(count int, decodeElt func(i int) error) error {
+	for i := 0; i < count; i++ {
+		if err := decodeElt(i); err != nil {
+			return err
+		}
+	}
+	// Check that we have the list termination mark
+	return d.decodeNil()
+}
+
+func (d *decodeState) decodeBertString(val reflect.Value) error {
 	// Read Tag
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	dataType, err := d.readTag()
 	if err != nil {
 		return err
 	}
@@ -246,11 +703,10 @@ func decodeBertString(r io.Reader, val reflect.Value) error {
 	var strType int
 
 	// Compare expected type
-	dataType := int(byte1[0])
 	switch dataType {
 
 	case TagSmallAtomUTF8:
-		data, err := decodeString1(r)
+		data, err := d.decodeString1()
 		if err != nil {
 			return err
 		}
@@ -258,7 +714,7 @@ func decodeBertString(r io.Reader, val reflect.Value) error {
 		strType = StringTypeAtom
 
 	case TagDeprecatedAtom, TagAtomUTF8:
-		data, err := decodeString2(r)
+		data, err := d.decodeString2()
 		if err != nil {
 			return err
 		}
@@ -266,15 +722,15 @@ func decodeBertString(r io.Reader, val reflect.Value) error {
 		strType = StringTypeAtom
 
 	case TagString:
-		data, err := decodeString2(r)
+		data, err := d.decodeString2()
 		if err != nil {
 			return err
 		}
-		strValue = string(data)
+		strValue = latin1String(data)
 		strType = StringTypeString
 
 	case TagBinary:
-		data, err := decodeString4(r)
+		data, err := d.decodeString4()
 		if err != nil {
 			return err
 		}
@@ -282,7 +738,7 @@ func decodeBertString(r io.Reader, val reflect.Value) error {
 		strType = StringTypeString
 
 	case TagList:
-		data, err := decodeCharList(r)
+		data, err := d.decodeCharList()
 		if err != nil {
 			return err
 		}
@@ -301,19 +757,965 @@ func decodeBertString(r io.Reader, val reflect.Value) error {
 	return nil
 }
 
-// Read a nil value and return error in case of unexpected value.
-// Nil is expected as a marker for end of lists.
-func decodeNil(r io.Reader) error {
-	// Read Tag
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+// ============================================================================
+// Decode bitstrings
+
+// decodeBitString decodes a bitstring or a binary into a BitString.
+func (d *decodeState) decodeBitString(b *BitString) error {
+	tag, err := d.readTag()
 	if err != nil {
 		return err
 	}
 
-	if byte1[0] != byte(TagNil) {
-		return fmt.Errorf("could not find nil: %d", byte1[0])
+	switch tag {
+	case TagBinary:
+		data, err := d.decodeString4()
+		if err != nil {
+			return err
+		}
+		*b = BitString{Bytes: d.keep(data), Bits: 8}
+		return nil
+	case TagBitBinary:
+		bs, err := d.decodeBitStringBody()
+		if err == nil {
+			*b = bs
+		}
+		return err
+	}
+
+	return fmt.Errorf("cannot decode %s as bitstring", tagName(tag))
+}
+
+// decodeBitStringBody decodes a BIT_BINARY_EXT whose tag has already been read.
+func (d *decodeState) decodeBitStringBody() (BitString, error) {
+	length, err := d.readUint32()
+	if err != nil {
+		return BitString{}, err
+	}
+	if err := d.checkBinarySize(length); err != nil {
+		return BitString{}, err
+	}
+	bits, err := d.readByte()
+	if err != nil {
+		return BitString{}, err
+	}
+	if bits == 0 || bits > 8 {
+		return BitString{}, fmt.Errorf("invalid number of bits in bitstring last byte: %d", bits)
+	}
+
+	data, err := d.view(int(length))
+	if err != nil {
+		return BitString{}, err
 	}
+	return BitString{Bytes: d.keep(data), Bits: bits}, nil
+}
 
-	return nil
+// ============================================================================
+// Decode lists
+
+// decodeList decodes an Erlang list into a Go slice or array.
+// Strings (lists of small integers optimized by Erlang) can be decoded into slices of integers.
+// Binaries can be decoded into byte slices or arrays.
+func (d *decodeState) decodeList(val reflect.Value) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case TagBinary, TagBitBinary:
+		if val.Type().Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		var data []byte
+		if tag == TagBinary {
+			data, err = d.decodeString4()
+		} else {
+			var b BitString
+			b, err = d.decodeBitStringBody()
+			if err == nil && b.Bits != 8 {
+				err = fmt.Errorf("cannot decode bitstring of %d bits to %s", b.BitLen(), val.Type())
+			}
+			data = b.Bytes
+		}
+		if err != nil {
+			return err
+		}
+		// SetBytes accepts any slice of bytes, including named element types
+		if val.Kind() == reflect.Slice {
+			val.SetBytes(d.keep(data))
+			return nil
+		}
+		if err := makeList(val, len(data)); err != nil {
+			return err
+		}
+		if val.Type().Elem() == reflect.TypeOf(data).Elem() {
+			reflect.Copy(val, reflect.ValueOf(data))
+			return nil
+		}
+		for i, b := range data {
+			val.Index(i).SetUint(uint64(b))
+		}
+		return nil
+
+	case TagNil:
+		return makeList(val, 0)
+
+	case TagString:
+		data, err := d.decodeString2()
+		if err != nil {
+			return err
+		}
+		if err := makeList(val, len(data)); err != nil {
+			return err
+		}
+		for i, b := range data {
+			if err := setInt(val.Index(i), int64(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case TagList:
+		count, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		if val.Kind() == reflect.Slice && (val.IsNil() || val.Len() != count) {
+			// The slice grows as elements are decoded, to not allocate more than the input
+			elem := val.Type().Elem()
+			val.Set(reflect.MakeSlice(val.Type(), 0, capacity(count, elem.Size())))
+			return d.decodeListElts(count, func(i int) error {
+				val.Set(reflect.Append(val, reflect.Zero(elem)))
+				return d.decodeData(val.Index(i).Addr().Interface())
+			})
+		}
+		if err := makeList(val, count); err != nil {
+			return err
+		}
+		return d.decodeListElts(count, func(i int) error {
+			return d.decodeData(val.Index(i).Addr().Interface())
+		})
+	}
+
+	return fmt.Errorf("cannot decode %s to %s", tagName(tag), val.Type())
+}
+
+// decodeImproperList decodes a list and its tail. Proper lists can also be decoded
+// to ImproperList, their tail being the empty list.
+func (d *decodeState) decodeImproperList(l *ImproperList) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	switch tag {
+	case TagNil:
+		*l = ImproperList{Elems: []interface{}{}, Tail: List{}}
+		return nil
+	case TagString:
+		data, err := d.decodeString2()
+		if err != nil {
+			return err
+		}
+		elems := make([]interface{}, len(data))
+		for i, c := range data {
+			elems[i] = int64(c)
+		}
+		*l = ImproperList{Elems: elems, Tail: List{}}
+		return nil
+	case TagList:
+	default:
+		return fmt.Errorf("cannot decode %s to improper list", tagName(tag))
+	}
+	count, err := d.readCount()
+	if err != nil {
+		return err
+	}
+
+	elems := make([]interface{}, 0, capacity(count, termSize))
+	for i := 0; i < count; i++ {
+		elem, err := d.decodeTerm()
+		if err != nil {
+			return err
+		}
+		elems = append(elems, elem)
+	}
+	tail, err := d.decodeTerm()
+	if err != nil {
+		return err
+	}
+
+	*l = ImproperList{Elems: elems, Tail: tail}
+	return nil
+}
+
+// makeList prepares a slice or array target to receive length elements.
+// Arrays must have exactly the same length as the decoded list. Slices of the same
+// length are kept, as their elements can be pointers to decoding targets.
+func makeList(val reflect.Value, length int) error {
+	if val.Kind() == reflect.Array {
+		if val.Len() != length {
+			return fmt.Errorf("cannot decode list of length %d to %s", length, val.Type())
+		}
+		return nil
+	}
+	if !val.IsNil() && val.Len() == length {
+		return nil
+	}
+	val.Set(reflect.MakeSlice(val.Type(), length, length))
+	return nil
+}
+
+// setInt stores an integer in a numeric or interface{} value.
+func setInt(val reflect.Value, i int64) error {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if val.OverflowInt(i) {
+			return &RangeError{Value: strconv.FormatInt(i, 10), Type: val.Type()}
+		}
+		val.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || val.OverflowUint(uint64(i)) {
+			return &RangeError{Value: strconv.FormatInt(i, 10), Type: val.Type()}
+		}
+		val.SetUint(uint64(i))
+	case reflect.Interface:
+		val.Set(reflect.ValueOf(i))
+	default:
+		return fmt.Errorf("cannot decode integer to %s", val.Type())
+	}
+	return nil
+}
+
+// setBigInt stores a big integer in an integer value. Only unsigned values can hold
+// integers larger than int64.
+func setBigInt(val reflect.Value, i *big.Int) error {
+	if i.IsInt64() {
+		return setInt(val, i.Int64())
+	}
+	switch val.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i.IsUint64() && !val.OverflowUint(i.Uint64()) {
+			val.SetUint(i.Uint64())
+			return nil
+		}
+	}
+	return &RangeError{Value: i.String(), Type: val.Type()}
+}
+
+// decodeTuple decodes a tuple to a Tuple. If the Tuple already has elements, they
+// are used as targets: they can be pointers to decode the elements to specific types.
+func (d *decodeState) decodeTuple(t *Tuple) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	length, err := d.readTupleLength(tag)
+	if err != nil {
+		return err
+	}
+
+	if t.Elems == nil {
+		elems := make([]interface{}, 0, capacity(length, termSize))
+		for i := 0; i < length; i++ {
+			var elem interface{}
+			if err := d.decodeData(&elem); err != nil {
+				return err
+			}
+			elems = append(elems, elem)
+		}
+		t.Elems = elems
+		return nil
+	}
+	if len(t.Elems) != length {
+		return fmt.Errorf("cannot decode tuple of length %d to Tuple of length %d", length, len(t.Elems))
+	}
+	for i := range t.Elems {
+		if err := d.decodeData(&t.Elems[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// Decode maps
+
+// decodeMap decodes an Erlang map into a Go map. Keys and values are decoded
+// recursively to the key and element types of the target map.
+func (d *decodeState) decodeMap(val reflect.Value) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagMap {
+		return fmt.Errorf("cannot decode %s to map %s", tagName(tag), val.Type())
+	}
+	arity, err := d.readCount()
+	if err != nil {
+		return err
+	}
+
+	mapType := val.Type()
+	if val.IsNil() {
+		val.Set(reflect.MakeMapWithSize(mapType, capacity(arity, mapType.Key().Size()+mapType.Elem().Size())))
+	}
+	for i := 0; i < arity; i++ {
+		key := reflect.New(mapType.Key())
+		if err := d.decodeData(key.Interface()); err != nil {
+			return err
+		}
+		// Interface keys hold the decoded term, which may not be hashable,
+		// such as binaries and tuples
+		if t := reflect.TypeOf(key.Elem().Interface()); t != nil && !t.Comparable() {
+			return fmt.Errorf("cannot use %s as map key in %s: decode to Map instead", t, mapType)
+		}
+		elem := reflect.New(mapType.Elem())
+		if err := d.decodeData(elem.Interface()); err != nil {
+			return err
+		}
+		val.SetMapIndex(key.Elem(), elem.Elem())
+	}
+	return nil
+}
+
+// decodeMapTerm decodes an Erlang map to a Map.
+func (d *decodeState) decodeMapTerm(val reflect.Value) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagMap {
+		return fmt.Errorf("cannot decode %s to %s", tagName(tag), val.Type())
+	}
+	arity, err := d.readCount()
+	if err != nil {
+		return err
+	}
+
+	m := make(Map, 0, capacity(arity, entrySize))
+	for i := 0; i < arity; i++ {
+		var e MapEntry
+		if err := d.decodeData(&e.Key); err != nil {
+			return err
+		}
+		if err := d.decodeData(&e.Value); err != nil {
+			return err
+		}
+		m = append(m, e)
+	}
+	val.Set(reflect.ValueOf(m))
+	return nil
+}
+
+// ============================================================================
+// Decode process, port and reference identifiers
+
+func (d *decodeState) decodePid(pid *Pid) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	p, err := d.decodePidBody(tag)
+	if err == nil {
+		*pid = p
+	}
+	return err
+}
+
+// decodePidBody decodes a pid whose tag has already been read. Legacy PID_EXT
+// only differs from NEW_PID_EXT by its creation field, stored on a single byte.
+func (d *decodeState) decodePidBody(tag int) (Pid, error) {
+	var pid Pid
+	if tag != TagNewPid && tag != TagPid {
+		return pid, fmt.Errorf("cannot decode %s as pid", tagName(tag))
+	}
+
+	node, err := d.readAtom()
+	if err != nil {
+		return pid, err
+	}
+	pid.Node = node
+	if pid.ID, err = d.readUint32(); err != nil {
+		return pid, err
+	}
+	if pid.Serial, err = d.readUint32(); err != nil {
+		return pid, err
+	}
+	pid.Creation, err = d.readCreation(tag == TagPid)
+	return pid, err
+}
+
+func (d *decodeState) decodePort(port *Port) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	p, err := d.decodePortBody(tag)
+	if err == nil {
+		*port = p
+	}
+	return err
+}
+
+// decodePortBody decodes a port whose tag has already been read.
+// V4_PORT_EXT has a 64 bits ID, and legacy PORT_EXT has a single byte creation.
+func (d *decodeState) decodePortBody(tag int) (Port, error) {
+	var port Port
+	if tag != TagNewPort && tag != TagV4Port && tag != TagPort {
+		return port, fmt.Errorf("cannot decode %s as port", tagName(tag))
+	}
+
+	node, err := d.readAtom()
+	if err != nil {
+		return port, err
+	}
+	port.Node = node
+	if tag == TagV4Port {
+		if port.ID, err = d.readUint64(); err != nil {
+			return port, err
+		}
+	} else {
+		id, err := d.readUint32()
+		if err != nil {
+			return port, err
+		}
+		port.ID = uint64(id)
+	}
+	port.Creation, err = d.readCreation(tag == TagPort)
+	return port, err
+}
+
+func (d *decodeState) decodeRef(ref *Ref) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	rf, err := d.decodeRefBody(tag)
+	if err == nil {
+		*ref = rf
+	}
+	return err
+}
+
+// decodeRefBody decodes a reference whose tag has already been read.
+// NEWER_REFERENCE_EXT and NEW_REFERENCE_EXT start with the number of ID words and differ by
+// the size of their creation field. Legacy REFERENCE_EXT has a single ID word after the node.
+func (d *decodeState) decodeRefBody(tag int) (Ref, error) {
+	var ref Ref
+	var err error
+
+	switch tag {
+	case TagNewerReference, TagNewReference:
+		count, err := d.readUint16()
+		if err != nil {
+			return ref, err
+		}
+		if ref.Node, err = d.readAtom(); err != nil {
+			return ref, err
+		}
+		if ref.Creation, err = d.readCreation(tag == TagNewReference); err != nil {
+			return ref, err
+		}
+		ref.ID = make([]uint32, count)
+		for i := range ref.ID {
+			if ref.ID[i], err = d.readUint32(); err != nil {
+				return ref, err
+			}
+		}
+		return ref, nil
+
+	case TagReference:
+		if ref.Node, err = d.readAtom(); err != nil {
+			return ref, err
+		}
+		id, err := d.readUint32()
+		if err != nil {
+			return ref, err
+		}
+		ref.ID = []uint32{id}
+		ref.Creation, err = d.readCreation(true)
+		return ref, err
+	}
+
+	return ref, fmt.Errorf("cannot decode %s as reference", tagName(tag))
+}
+
+// readCreation reads the creation field of an identifier.
+// Legacy identifiers store it on a single byte, current ones on 32 bits.
+func (d *decodeState) readCreation(legacy bool) (uint32, error) {
+	if !legacy {
+		return d.readUint32()
+	}
+	b, err := d.readByte()
+	return uint32(b), err
+}
+
+// ============================================================================
+// Decode functions
+
+func (d *decodeState) decodeExport(e *Export) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagExport {
+		return fmt.Errorf("cannot decode %s as export", tagName(tag))
+	}
+	export, err := d.decodeExportBody()
+	if err == nil {
+		*e = export
+	}
+	return err
+}
+
+// decodeExportBody decodes the module, function and arity of an export whose tag has
+// already been read.
+func (d *decodeState) decodeExportBody() (Export, error) {
+	var e Export
+	var err error
+	if e.Module, err = d.readAtom(); err != nil {
+		return e, err
+	}
+	if e.Function, err = d.readAtom(); err != nil {
+		return e, err
+	}
+	arity, err := d.decodeInt()
+	if err != nil {
+		return e, err
+	}
+	if arity < 0 || arity > 255 {
+		return e, fmt.Errorf("invalid export arity: %d", arity)
+	}
+	e.Arity = uint8(arity)
+	return e, nil
+}
+
+func (d *decodeState) decodeFun(f *Fun) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagNewFun {
+		return fmt.Errorf("cannot decode %s as fun", tagName(tag))
+	}
+	fun, err := d.decodeFunBody()
+	if err == nil {
+		*f = fun
+	}
+	return err
+}
+
+// decodeFunBody decodes a NEW_FUN_EXT whose tag has already been read.
+// The total size of the fun is known from its header, so we read it at once, to keep
+// the original encoding, and parse its content from memory.
+func (d *decodeState) decodeFunBody() (Fun, error) {
+	var f Fun
+	size, err := d.readUint32()
+	if err != nil {
+		return f, err
+	}
+	// Size includes the size field itself
+	if size < 4+1+16+4+4 {
+		return f, fmt.Errorf("invalid fun size: %d", size)
+	}
+
+	content, err := d.view(int(size) - 4)
+	if err != nil {
+		return f, err
+	}
+	f.data = make([]byte, 1+size)
+	f.data[0] = TagNewFun
+	binary.BigEndian.PutUint32(f.data[1:], size)
+	copy(f.data[5:], content)
+
+	content = f.data[5:]
+	f.Arity = content[0]
+	copy(f.Uniq[:], content[1:17])
+	f.Index = binary.BigEndian.Uint32(content[17:])
+	numFree := binary.BigEndian.Uint32(content[21:])
+
+	// view already counted the body: the body decoder starts counting before it,
+	// so that it is counted only once
+	body := content[25:]
+	fd := &decodeState{data: body, opts: d.opts, bytes: d.bytes - int64(len(body)), depth: d.depth}
+	if f.Module, err = fd.readAtom(); err != nil {
+		return f, err
+	}
+	if f.OldIndex, err = fd.decodeInt(); err != nil {
+		return f, err
+	}
+	if f.OldUniq, err = fd.decodeInt(); err != nil {
+		return f, err
+	}
+	if err := fd.decodePid(&f.Pid); err != nil {
+		return f, err
+	}
+	for i := uint32(0); i < numFree; i++ {
+		v, err := fd.decodeTerm()
+		if err != nil {
+			return f, err
+		}
+		f.FreeVars = append(f.FreeVars, v)
+	}
+	if left := len(fd.data) - fd.off; left != 0 {
+		return f, fmt.Errorf("fun size mismatch: %d bytes left", left)
+	}
+	return f, nil
+}
+
+// ============================================================================
+// Decode raw terms
+
+// rawTerm reads the next term without decoding it, and returns its encoding,
+// prefixed with the version tag.
+func (d *decodeState) rawTerm() ([]byte, error) {
+	if d.r == nil {
+		start := d.off
+		if err := d.skipTerm(); err != nil {
+			return nil, err
+		}
+		raw := make([]byte, 1+d.off-start)
+		raw[0] = TagETFVersion
+		copy(raw[1:], d.data[start:d.off])
+		return raw, nil
+	}
+
+	// Keep the bytes read from the stream
+	d.capture = []byte{TagETFVersion}
+	err := d.skipTerm()
+	raw := d.capture
+	d.capture = nil
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// skipTerm reads the next term without decoding it. Any valid term can be skipped,
+// and the decoding limits are checked as if the term was decoded.
+func (d *decodeState) skipTerm() error {
+	return d.walkTerm(skipVisitor{})
+}
+
+// ============================================================================
+// Decode generic terms
+
+// decodeTerm decodes any supported Erlang term without a target type.
+// The returned value can be encoded back to the same Erlang term.
+// Atoms are returned as String, integers as int64 (or *big.Int when they do not fit),
+// floats as float64, binaries as []byte, bitstrings as BitString, tuples as Tuple, lists as List
+// (or ImproperList) and maps as Map.
+// Process, port and reference identifiers are returned as Pid, Port and Ref, and functions
+// as Export or Fun.
+func (d *decodeState) decodeTerm() (interface{}, error) {
+	tag, err := d.readTag()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeTermBody(tag)
+}
+
+// decodeTermBody decodes a generic term whose tag has already been read.
+func (d *decodeState) decodeTermBody(tag int) (interface{}, error) {
+	switch tag {
+	case TagList, TagSmallTuple, TagLargeTuple, TagMap:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+	}
+
+	switch tag {
+	case TagSmallInteger, TagInteger:
+		return d.decodeIntBody(tag)
+
+	case TagSmallBig, TagLargeBig:
+		i, err := d.decodeBigIntBody(tag)
+		if err != nil {
+			return nil, err
+		}
+		if i.IsInt64() {
+			return i.Int64(), nil
+		}
+		return i, nil
+
+	case TagNewFloat, TagFloat:
+		return d.decodeFloatBody(tag)
+
+	case TagNewPid, TagPid:
+		return d.decodePidBody(tag)
+
+	case TagNewPort, TagV4Port, TagPort:
+		return d.decodePortBody(tag)
+
+	case TagNewerReference, TagNewReference, TagReference:
+		return d.decodeRefBody(tag)
+
+	case TagExport:
+		return d.decodeExportBody()
+
+	case TagNewFun:
+		return d.decodeFunBody()
+
+	case TagSmallAtomUTF8:
+		data, err := d.decodeString1()
+		return A(string(data)), err
+
+	case TagDeprecatedAtom, TagAtomUTF8:
+		data, err := d.decodeString2()
+		return A(string(data)), err
+
+	case TagBinary:
+		data, err := d.decodeString4()
+		if err != nil {
+			return nil, err
+		}
+		if d.opts.BinaryAsString {
+			return string(data), nil
+		}
+		return d.keep(data), nil
+
+	case TagBitBinary:
+		return d.decodeBitStringBody()
+
+	case TagString:
+		// STRING_EXT is an optimized encoding of a list of small integers
+		data, err := d.decodeString2()
+		if err != nil {
+			return nil, err
+		}
+		list := make(List, len(data))
+		for i, b := range data {
+			list[i] = int64(b)
+		}
+		return list, nil
+
+	case TagNil:
+		return List{}, nil
+
+	case TagList:
+		count, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		list := make(List, 0, capacity(count, termSize))
+		for i := 0; i < count; i++ {
+			elem, err := d.decodeTerm()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+
+		// Proper lists end with nil, improper lists with any other term
+		tailTag, err := d.readTag()
+		if err != nil {
+			return nil, err
+		}
+		if tailTag == TagNil {
+			return list, nil
+		}
+		tail, err := d.decodeTermBody(tailTag)
+		if err != nil {
+			return nil, err
+		}
+		return ImproperList{Elems: list, Tail: tail}, nil
+
+	case TagSmallTuple, TagLargeTuple:
+		length, err := d.readTupleLength(tag)
+		if err != nil {
+			return nil, err
+		}
+		elems := make([]interface{}, 0, capacity(length, termSize))
+		for i := 0; i < length; i++ {
+			elem, err := d.decodeTerm()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return Tuple{elems}, nil
+
+	case TagMap:
+		arity, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		m := make(Map, 0, capacity(arity, entrySize))
+		for i := 0; i < arity; i++ {
+			key, err := d.decodeTerm()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeTerm()
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, MapEntry{Key: key, Value: value})
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("cannot decode %s to generic term", tagName(tag))
+}
+
+// Read a nil value and return error in case of unexpected value.
+// Nil is expected as a marker for end of lists. Improper lists end with
+// another term, which is decoded to be reported in the error.
+func (d *decodeState) decodeNil() error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag == TagNil {
+		return nil
+	}
+
+	tail, err := d.decodeTermBody(tag)
+	if err != nil {
+		return fmt.Errorf("could not find nil at end of list (%s): %v", tagName(tag), err)
+	}
+	return fmt.Errorf("improper list with tail %s %v: decode it to ImproperList", tagName(tag), tail)
+}
+
+// ============================================================================
+// Helpers
+
+// readTag reads the tag identifying the type of the next Erlang term.
+func (d *decodeState) readTag() (int, error) {
+	b, err := d.readByte()
+	return int(b), err
+}
+
+// readByte reads a single byte.
+func (d *decodeState) readByte() (byte, error) {
+	if err := d.read(d.scratch[:1]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return d.scratch[0], nil
+}
+
+// readUint16 reads a big endian 16 bits length field.
+func (d *decodeState) readUint16() (uint16, error) {
+	if err := d.read(d.scratch[:2]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint16(d.scratch[:]), nil
+}
+
+// readUint32 reads a big endian 32 bits length or arity field.
+func (d *decodeState) readUint32() (uint32, error) {
+	if err := d.read(d.scratch[:4]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint32(d.scratch[:]), nil
+}
+
+// readUint64 reads a big endian 64 bits integer.
+func (d *decodeState) readUint64() (uint64, error) {
+	if err := d.read(d.scratch[:8]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint64(d.scratch[:]), nil
+}
+
+// read fills p from the input. Like io.ReadFull, it returns io.EOF if no bytes
+// were read, and io.ErrUnexpectedEOF if only some of them were.
+func (d *decodeState) read(p []byte) error {
+	if err := d.reserve(len(p)); err != nil {
+		return err
+	}
+	if d.r != nil {
+		n, err := io.ReadFull(d.r, p)
+		if d.capture != nil {
+			d.capture = append(d.capture, p[:n]...)
+		}
+		return err
+	}
+	if d.off == len(d.data) && len(p) > 0 {
+		return io.EOF
+	}
+	n := copy(p, d.data[d.off:])
+	d.off += n
+	if n < len(p) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// unread puts back the last bytes read, so that they are read again.
+func (d *decodeState) unread(p []byte) {
+	d.bytes -= int64(len(p))
+	if d.r == nil {
+		d.off -= len(p)
+		return
+	}
+	d.r = io.MultiReader(bytes.NewReader(p), d.r)
+	if d.capture != nil {
+		d.capture = d.capture[:len(d.capture)-len(p)]
+	}
+}
+
+// view returns the next n bytes of the input. When decoding from memory, it is a slice
+// of the input, which must not be modified, and must be copied with keep to be retained.
+func (d *decodeState) view(n int) ([]byte, error) {
+	if err := d.reserve(n); err != nil {
+		return nil, err
+	}
+	if d.r != nil {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if d.capture != nil {
+			d.capture = append(d.capture, data...)
+		}
+		return data, nil
+	}
+	if n > len(d.data)-d.off {
+		d.off = len(d.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := d.data[d.off : d.off+n : d.off+n]
+	d.off += n
+	return data, nil
+}
+
+// skip reads n bytes and discards them.
+func (d *decodeState) skip(n int) error {
+	_, err := d.view(n)
+	return err
+}
+
+// keep returns data returned by view that is retained in a decoded value.
+// Data read from memory is copied, unless the AliasBytes option is set.
+func (d *decodeState) keep(data []byte) []byte {
+	if d.r != nil || d.opts.AliasBytes {
+		return data
+	}
+	b := make([]byte, len(data))
+	copy(b, data)
+	return b
+}
+
+// unexpectedEOF reports the end of the input in the middle of a term as an error.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readTupleLength reads the arity of a tuple whose tag has already been read.
+func (d *decodeState) readTupleLength(tag int) (int, error) {
+	switch tag {
+	case TagSmallTuple:
+		length, err := d.readByte()
+		return int(length), err
+	case TagLargeTuple:
+		return d.readCount()
+	default:
+		return 0, fmt.Errorf("cannot decode type %s as tuple", tagName(tag))
+	}
 }
@@ -1,7 +1,6 @@
 package bertrpc // import "gosrc.io/erlang/bertrpc"
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -16,36 +15,25 @@ var ErrReturn = errors.New("function returns 'error'")
 // If we pass an empty struct it means we do not care about the reply and we will not try to decode
 // Erlang return.
 func DecodeReply(r io.Reader, term interface{}) error {
-	// Guard against nil decoding target  as it does not guide the decoding
-	if term == nil {
-		return fmt.Errorf("target type for decoding cannot be nil")
+	// Guard against nil and non-pointer targets, which cannot receive the decoded term
+	if err := checkTarget(term); err != nil {
+		return err
 	}
 
 	// 1. Read BERP length
-	byte4 := make([]byte, 4)
-	n, err := r.Read(byte4)
-	if err != nil {
+	d := &decodeState{r: r}
+	// TODO: Keep track of the length of the data read, to be able to skip to the end on failure.
+	if _, err := d.readUint32(); err != nil {
 		return err
 	}
-	if n < 4 {
-		return fmt.Errorf("truncated data")
-	}
-	// TODO: Keep track of the length of the data read, to be able to skip to the end on failure.
-	_ = int(binary.BigEndian.Uint32(byte4))
 
 	// 2. Read Erlang Term Format "magic byte"
-	byte1 := make([]byte, 1)
-	_, err = r.Read(byte1)
-	if err != nil {
+	if err := d.readHeader(); err != nil {
 		return err
 	}
-	if byte1[0] != byte(TagETFVersion) {
-		// Bad Version tag (aka 'magic number')
-		return fmt.Errorf("incorrect Erlang Term version tag: %d", byte1[0])
-	}
 
 	// 3. Read the reply tuple header
-	length, err := readTupleInfo(r)
+	length, err := d.readTupleInfo()
 	if err != nil {
 		return err
 	}
@@ -54,7 +42,7 @@ func DecodeReply(r io.Reader, term interface{}) error {
 	}
 
 	// 4. Read the first Atom
-	tag, err := readAtom(r)
+	tag, err := d.readAtom()
 	if err != nil {
 		return err
 	}
@@ -63,7 +51,7 @@ func DecodeReply(r io.Reader, term interface{}) error {
 	switch tag {
 	case "reply":
 		// Read the result of the function call
-		if err := decodeData(r, term); err != nil {
+		if err := d.decodeData(term); err != nil {
 			return err
 		}
 
@@ -79,8 +67,7 @@ func DecodeReply(r io.Reader, term interface{}) error {
 // ============================================================================
 // Decode Erlang Term format into a Go structure
 
-// TODO ignore unexported fields
-func decodeStruct(r io.Reader, val reflect.Value) error {
+func (d *decodeState) decodeStruct(val reflect.Value) error {
 	// If the struct is empty, we assume caller is not interested in the result
 	// and we do not try to decode anything.
 	if val.NumField() == 0 {
@@ -90,42 +77,38 @@ func decodeStruct(r io.Reader, val reflect.Value) error {
 	// Get the first field of the interface we are decoding to, to determine
 	// if we are decoding a target value.
 	// It must be a string and be tagged as erlang:"tag"
-	structType := val.Type()
-	field1 := structType.Field(0)
-	tag, ok := field1.Tag.Lookup("erlang")
-	if ok && tag == "tag" && field1.Type.Kind() == reflect.String {
-		return decodeTaggedValue(r, val)
+	if isTaggedStruct(val.Type()) {
+		return d.decodeTaggedValue(val)
 	}
-	return decodeUntaggedStruct(r, val)
+	return d.decodeUntaggedStruct(val)
 }
 
-func decodeTaggedValue(r io.Reader, val reflect.Value) error {
+func (d *decodeState) decodeTaggedValue(val reflect.Value) error {
 	// We need to read Erlang data type. If we have an atom, it will be the tag.
 	// If we have a tuple, We expect first element to be the tag.
 	// If we have something else, we try to decode it in an untagged field.
 	// Read the type of data
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	tag, err := d.readTag()
 	if err != nil {
 		return err
 	}
 
-	switch int(byte1[0]) {
+	switch tag {
 	// We are directly decoding the tag, return it inside the struct:
 	case TagDeprecatedAtom, TagAtomUTF8, TagSmallAtomUTF8:
-		return readTagAtom(r, int(byte1[0]), val)
+		return d.readTagAtom(tag, val)
 	case TagSmallTuple, TagLargeTuple:
-		return readTagTuple(r, int(byte1[0]), val)
+		return d.readTagTuple(tag, val)
 	}
 	// We did not find any field to decode the tag to
 	return fmt.Errorf("decodeTaggedValue could not read atom or taggedTuple")
 }
 
-func readTagAtom(r io.Reader, erlangType int, val reflect.Value) error {
+func (d *decodeState) readTagAtom(erlangType int, val reflect.Value) error {
 	switch erlangType {
 	// We are directly decoding the tag, return it inside the struct:
 	case TagDeprecatedAtom, TagAtomUTF8:
-		data, err := decodeString2(r)
+		data, err := d.decodeString2()
 		if err != nil {
 			return err
 		}
@@ -133,7 +116,7 @@ func readTagAtom(r io.Reader, erlangType int, val reflect.Value) error {
 		field1.SetString(string(data))
 		return nil
 	case TagSmallAtomUTF8:
-		data, err := decodeString1(r)
+		data, err := d.decodeString1()
 		if err != nil {
 			return err
 		}
@@ -145,30 +128,15 @@ func readTagAtom(r io.Reader, erlangType int, val reflect.Value) error {
 	}
 }
 
-func readTagTuple(r io.Reader, erlangType int, val reflect.Value) error {
+func (d *decodeState) readTagTuple(erlangType int, val reflect.Value) error {
 	// Get tuple length
-	byte1 := make([]byte, 1)
-	length := 0
-	switch erlangType {
-	case TagSmallTuple:
-		_, err := r.Read(byte1)
-		if err != nil {
-			return err
-		}
-		length = int(byte1[0])
-	case TagLargeTuple:
-		byte4 := make([]byte, 4)
-		n, err := r.Read(byte4)
-		if err != nil {
-			return err
-		}
-		if n < 4 {
-			return fmt.Errorf("truncated data")
-		}
-		length = int(binary.BigEndian.Uint32(byte4))
-	default:
+	if erlangType != TagSmallTuple && erlangType != TagLargeTuple {
 		return fmt.Errorf("readTagTuple unexpected mismatch: %d", erlangType)
 	}
+	length, err := d.readTupleLength(erlangType)
+	if err != nil {
+		return err
+	}
 
 	// An empty tuple cannot have a tag
 	if length == 0 {
@@ -176,7 +144,7 @@ func readTagTuple(r io.Reader, erlangType int, val reflect.Value) error {
 	}
 
 	// Extract first field as tag
-	data, err := readAtom(r)
+	data, err := d.readAtom()
 	tag := string(data)
 	if err != nil {
 		return fmt.Errorf("cannot read atom as first tuple element")
@@ -184,30 +152,32 @@ func readTagTuple(r io.Reader, erlangType int, val reflect.Value) error {
 	field1 := val.Field(0)
 	field1.SetString(tag)
 
-	// Match all others fields against the tag name constraint to decode the fields one by one
-	structType := val.Type()
-	for i := 1; i < structType.NumField(); i++ {
-		field := structType.Field(i)
-		if t, ok := field.Tag.Lookup("erlang"); ok {
-			if t == "tag:"+tag {
-				currField := val.Field(i)
-				if currField.Kind() == reflect.Ptr {
-					currField = currField.Elem()
-				}
-				if currField.CanAddr() {
-					err := decodeData(r, currField.Addr().Interface())
-					if err != nil {
-						return err
-					}
-				}
+	// Match all others fields against the tag name constraint to decode the fields one by one,
+	// in position order.
+	fields := tagFields(getStructInfo(val.Type()), tag)
+	if len(fields) == 0 {
+		// We are not interested in the payload of that tag
+		for i := 1; i < length; i++ {
+			if _, err := d.decodeTerm(); err != nil {
+				return err
 			}
 		}
+		return nil
+	}
+	if len(fields) != length-1 {
+		return fmt.Errorf("cannot decode tuple {%s, ...} of length %d to %d tagged fields", tag, length, len(fields))
+	}
+
+	for _, f := range fields {
+		if err := d.decodeField(val, f); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 /*
-func readOtherData(r io.Reader, tagName int, val reflect.Value) error {
+func (d *decodeState) readOtherData(tagName int, val reflect.Value) error {
 	if val.Kind() == reflect.Ptr {
 		val = val.Elem()
 	}
@@ -217,13 +187,13 @@ func readOtherData(r io.Reader, tagName int, val reflect.Value) error {
 	case reflect.Int8:
 		return ErrRange
 	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := decodeInt(r) // TODO Point to partial decodeInt, passing the Erlang type that was already read
+		i, err := d.decodeInt() // TODO Point to partial decodeInt, passing the Erlang type that was already read
 		if err == nil {
 			val.SetInt(i)
 		}
 		return err
 	case reflect.String:
-		s, err := decodeString(r) // TODO Point to partial decodeString, passing the Erlang type that was already read
+		s, err := d.decodeString() // TODO Point to partial decodeString, passing the Erlang type that was already read
 		if err == nil {
 			val.SetString(s)
 		}
@@ -237,57 +207,108 @@ func readOtherData(r io.Reader, tagName int, val reflect.Value) error {
 
 // ============================================================================
 
-func decodeUntaggedStruct(r io.Reader, val reflect.Value) error {
+func (d *decodeState) decodeUntaggedStruct(val reflect.Value) error {
 	// 1. Get the Erlang type of the tuple
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+
+	var length int
+	switch tag {
+	case TagSmallTuple, TagLargeTuple:
+		if length, err = d.readTupleLength(tag); err != nil {
+			return err
+		}
+	case TagMap:
+		return d.decodeMapToStruct(val)
+
+	default:
+		return fmt.Errorf("cannot decode type %s to struct %s", tagName(tag), val.Type())
+	}
+
+	return d.decodeStructElts(length, val)
+}
+
+// decodeMapToStruct decodes the content of an Erlang map into a struct.
+// Map keys can be atoms or binaries. They are matched against the struct fields
+// (see fieldByKey). Values whose keys do not match any field are ignored.
+func (d *decodeState) decodeMapToStruct(val reflect.Value) error {
+	arity, err := d.readCount()
 	if err != nil {
 		return err
 	}
 
-	length := 0
-	switch int(byte1[0]) {
-	case TagSmallTuple:
-		_, err := r.Read(byte1)
+	for i := 0; i < arity; i++ {
+		tag, err := d.readTag()
 		if err != nil {
 			return err
 		}
-		length = int(byte1[0])
-	case TagLargeTuple:
-		byte4 := make([]byte, 4)
-		n, err := r.Read(byte4)
+
+		// Atom and binary keys are matched without being decoded
+		var key []byte
+		switch tag {
+		case TagSmallAtomUTF8:
+			key, err = d.decodeString1()
+		case TagDeprecatedAtom, TagAtomUTF8:
+			key, err = d.decodeString2()
+		case TagBinary:
+			key, err = d.decodeString4()
+		default:
+			_, err = d.decodeTermBody(tag)
+		}
 		if err != nil {
 			return err
 		}
-		if n < 4 {
-			return fmt.Errorf("truncated data")
+
+		var f fieldInfo
+		found := false
+		if key != nil {
+			f, found = fieldByKey(val.Type(), string(key))
 		}
-		length = int(binary.BigEndian.Uint32(byte4))
 
-	default:
-		return fmt.Errorf("cannot decode type %s to struct %s", tagName(int(byte1[0])), val.Type())
-	}
+		// Skip values we do not have a field for
+		if !found {
+			if _, err := d.decodeTerm(); err != nil {
+				return err
+			}
+			continue
+		}
 
-	return decodeStructElts(r, length, val)
+		if err := d.decodeField(val, f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func decodeStructElts(r io.Reader, length int, val reflect.Value) error {
+func (d *decodeState) decodeStructElts(length int, val reflect.Value) error {
+	info := getStructInfo(val.Type())
+	expected := len(info.fields)
+	if info.record != "" {
+		expected++
+	}
+
 	// If the tuple does not contain the expected number of fields in our struct
-	if length != val.NumField() {
+	if length != expected {
 		return fmt.Errorf("cannot decode tuple of length %d to struct", length)
 	}
 
-	// For each field, try to decode it recursively
-	for i := 0; i < length; i++ {
-		valueField := val.Field(i)
-		if valueField.Kind() == reflect.Ptr {
-			valueField = valueField.Elem()
+	// Records start with their name
+	if info.record != "" {
+		record, err := d.readAtom()
+		if err != nil {
+			return fmt.Errorf("cannot read record %s name: %v", info.record, err)
 		}
-		if valueField.CanAddr() {
-			err := decodeData(r, valueField.Addr().Interface())
-			if err != nil {
-				return err
-			}
+		if record != info.record {
+			return fmt.Errorf("cannot decode record %s to record %s", record, info.record)
+		}
+	}
+
+	// For each field, try to decode it recursively. Pointer fields are allocated.
+	for _, f := range info.fields {
+		if err := d.decodeField(val, f); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -296,65 +317,58 @@ func decodeStructElts(r io.Reader, length int, val reflect.Value) error {
 // ============================================================================
 // Helpers
 
+// decodeField decodes a struct field, using the representation set by its options.
+func (d *decodeState) decodeField(val reflect.Value, f fieldInfo) error {
+	field := val.Field(f.index)
+	if f.time != "" {
+		if field.Type() != timeType && field.Type() != reflect.PtrTo(timeType) {
+			return fmt.Errorf("%s option cannot be used on field %s of type %s",
+				f.time, val.Type().Field(f.index).Name, field.Type())
+		}
+		return d.decodeTimeTo(field, f.time)
+	}
+	return d.decodeData(field.Addr().Interface())
+}
+
 // Verify that we are reading a tuple and return the length of the tuple
-func readTupleInfo(r io.Reader) (int, error) {
+func (d *decodeState) readTupleInfo() (int, error) {
 	// 1. Read the type of data
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	tag, err := d.readTag()
 	if err != nil {
 		return 0, err
 	}
 
 	// 2. Return
-	tupleLength := 0
-	switch int(byte1[0]) {
-	case TagSmallTuple:
-		_, err := r.Read(byte1)
-		if err != nil {
-			return 0, err
-		}
-		tupleLength = int(byte1[0])
-	case TagLargeTuple:
-		byte4 := make([]byte, 4)
-		n, err := r.Read(byte4)
-		if err != nil {
-			return 0, err
-		}
-		if n < 4 {
-			return 0, fmt.Errorf("truncated data")
-		}
-		tupleLength = int(binary.BigEndian.Uint32(byte4))
-
+	switch tag {
+	case TagSmallTuple, TagLargeTuple:
+		return d.readTupleLength(tag)
 	default:
-		return 0, fmt.Errorf("cannot decode type %d to struct", int(byte1[0]))
+		return 0, fmt.Errorf("cannot decode type %d to struct", tag)
 	}
-
-	return tupleLength, nil
 }
 
-func readAtom(r io.Reader) (string, error) {
+func (d *decodeState) readAtom() (string, error) {
 	// Read the type of data
-	byte1 := make([]byte, 1)
-	_, err := r.Read(byte1)
+	tag, err := d.readTag()
 	if err != nil {
 		return "", err
 	}
 
-	switch int(byte1[0]) {
+	switch tag {
 	case TagDeprecatedAtom, TagAtomUTF8:
-		data, err := decodeString2(r)
+		data, err := d.decodeString2()
 		if err != nil {
 			return "", err
 		}
 		return string(data), nil
 	case TagSmallAtomUTF8:
-		data, err := decodeString1(r)
+		data, err := d.decodeString1()
 		if err != nil {
 			return "", err
 		}
 		return string(data), nil
 
 	default:
-		return "", fmt.Errorf("cannot decode type %d as atom", int(byte1[0]))
+		return "", fmt.Errorf("cannot decode type %d as atom", tag)
 	}
 }
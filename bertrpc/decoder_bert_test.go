@@ -2,6 +2,7 @@ package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"gosrc.io/erlang/bertrpc"
@@ -116,3 +117,44 @@ func TestDecodeOkStruct(t *testing.T) {
 		t.Errorf("incorrect from: %s", result.To)
 	}
 }
+
+func TestDecodeCompressedReply(t *testing.T) {
+	// {reply, <<"...">>}, compressed
+	payload := strings.Repeat("abcd", 50)
+	reply := bertrpc.T(bertrpc.A("reply"), payload)
+	data, err := bertrpc.EncodeWithOptions(reply, bertrpc.EncodeOptions{CompressionLevel: 6})
+	if err != nil {
+		t.Errorf("cannot encode reply: %s", err)
+		return
+	}
+	if data[1] != bertrpc.TagCompressed {
+		t.Errorf("reply was not compressed")
+		return
+	}
+	input := append([]byte{0, 0, 0, byte(len(data))}, data...)
+
+	var result string
+	if err := bertrpc.DecodeReply(bytes.NewBuffer(input), &result); err != nil {
+		t.Errorf("bert decoding failed: %s", err)
+		return
+	}
+	if result != payload {
+		t.Errorf("unexpected result: %s", result)
+	}
+}
+
+func TestDecodeRawTermReply(t *testing.T) {
+	// {reply, {ok, 110}}
+	input := []byte{0, 0, 0, 20, 131, 104, 2, 100, 0, 5, 114, 101, 112, 108, 121, 104, 2, 100, 0, 2, 111, 107,
+		97, 110}
+
+	var result bertrpc.RawTerm
+	if err := bertrpc.DecodeReply(bytes.NewBuffer(input), &result); err != nil {
+		t.Errorf("bert decoding failed: %s", err)
+		return
+	}
+	expected := bertrpc.RawTerm{131, 104, 2, 100, 0, 2, 111, 107, 97, 110}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("unexpected result: %v", result)
+	}
+}
@@ -2,19 +2,142 @@ package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"gosrc.io/erlang/bertrpc"
 )
 
+func TestDecodeNilTarget(t *testing.T) {
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 97, 42}), nil); err == nil {
+		t.Errorf("decoding to nil should fail")
+	}
+	var p *int
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 97, 42}), p); err == nil {
+		t.Errorf("decoding to a nil pointer should fail")
+	}
+}
+
 // Small Erlang Term type is Uint8. It cannot fit into an int8
 func TestDecodeInt8(t *testing.T) {
 	var i int8
 	buf := bytes.NewBuffer([]byte{131, 97, 255})
-	if err := bertrpc.Decode(buf, &i); err != bertrpc.ErrRange {
+	if err := bertrpc.Decode(buf, &i); !errors.Is(err, bertrpc.ErrRange) {
 		t.Errorf("Decoding an Erlang small integer into int8 should fail")
 	}
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer([]byte{131, 97, 255}), &i), "erlang number 255 overflows int8")
+
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 97, 127}), &i); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if i != 127 {
+		t.Errorf("incorrect decoded value: %d", i)
+	}
+}
+
+func TestDecodeIntWidths(t *testing.T) {
+	tests := []struct {
+		value    interface{} // Encoded value
+		target   interface{} // Pointer to the decoded value
+		want     interface{}
+		overflow bool
+	}{
+		{value: int64(math.MinInt8), target: new(int8), want: int8(math.MinInt8)},
+		{value: int64(math.MaxInt8), target: new(int8), want: int8(math.MaxInt8)},
+		{value: int64(math.MinInt8 - 1), target: new(int8), overflow: true},
+		{value: int64(math.MaxInt8 + 1), target: new(int8), overflow: true},
+		{value: int64(math.MinInt16), target: new(int16), want: int16(math.MinInt16)},
+		{value: int64(math.MaxInt16), target: new(int16), want: int16(math.MaxInt16)},
+		{value: int64(math.MinInt16 - 1), target: new(int16), overflow: true},
+		{value: int64(math.MaxInt16 + 1), target: new(int16), overflow: true},
+		{value: int64(math.MinInt32), target: new(int32), want: int32(math.MinInt32)},
+		{value: int64(math.MaxInt32), target: new(int32), want: int32(math.MaxInt32)},
+		{value: int64(math.MinInt32 - 1), target: new(int32), overflow: true},
+		{value: int64(math.MaxInt32 + 1), target: new(int32), overflow: true},
+		{value: int64(math.MinInt64), target: new(int64), want: int64(math.MinInt64)},
+		{value: int64(math.MaxInt64), target: new(int64), want: int64(math.MaxInt64)},
+		{value: new(big.Int).SetUint64(math.MaxInt64 + 1), target: new(int64), overflow: true},
+		{value: int64(-1), target: new(int), want: int(-1)},
+		{value: int64(0), target: new(uint8), want: uint8(0)},
+		{value: int64(math.MaxUint8), target: new(uint8), want: uint8(math.MaxUint8)},
+		{value: int64(-1), target: new(uint8), overflow: true},
+		{value: int64(math.MaxUint8 + 1), target: new(uint8), overflow: true},
+		{value: int64(math.MaxUint16), target: new(uint16), want: uint16(math.MaxUint16)},
+		{value: int64(math.MaxUint16 + 1), target: new(uint16), overflow: true},
+		{value: int64(math.MaxUint32), target: new(uint32), want: uint32(math.MaxUint32)},
+		{value: int64(math.MaxUint32 + 1), target: new(uint32), overflow: true},
+		{value: new(big.Int).SetUint64(math.MaxUint64), target: new(uint64), want: uint64(math.MaxUint64)},
+		{value: new(big.Int).Lsh(big.NewInt(1), 64), target: new(uint64), overflow: true},
+		{value: int64(-1), target: new(uint64), overflow: true},
+		{value: int64(42), target: new(uint), want: uint(42)},
+		{value: int64(42), target: new(uintptr), want: uintptr(42)},
+	}
+
+	for _, tc := range tests {
+		typ := reflect.TypeOf(tc.target).Elem()
+		t.Run(fmt.Sprintf("%v to %s", tc.value, typ), func(st *testing.T) {
+			data, err := bertrpc.Encode(tc.value)
+			if err != nil {
+				st.Errorf("cannot encode %v: %s", tc.value, err)
+				return
+			}
+			err = bertrpc.Decode(bytes.NewBuffer(data), tc.target)
+			if tc.overflow {
+				checkRangeError(st, err, fmt.Sprintf("erlang number %v overflows %s", tc.value, typ))
+				return
+			}
+			if err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if got := reflect.ValueOf(tc.target).Elem().Interface(); got != tc.want {
+				st.Errorf("incorrect decoded value: %v. expected: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIntSlice(t *testing.T) {
+	// Lists of small integers are encoded as strings
+	var small []uint16
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 107, 0, 2, 1, 255}), &small); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(small, []uint16{1, 255}) {
+		t.Errorf("incorrect decoded value: %v", small)
+	}
+
+	// [1, -1]
+	input := []byte{131, 108, 0, 0, 0, 2, 97, 1, 98, 255, 255, 255, 255, 106}
+	var values []uint32
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer(input), &values), "erlang number -1 overflows uint32")
+}
+
+// checkRangeError checks that err is a RangeError with the expected message.
+func checkRangeError(t *testing.T, err error, msg string) {
+	t.Helper()
+	rerr, ok := err.(*bertrpc.RangeError)
+	if !ok {
+		t.Errorf("expected a RangeError, got %v", err)
+		return
+	}
+	if !errors.Is(err, bertrpc.ErrRange) {
+		t.Errorf("RangeError should wrap ErrRange")
+	}
+	if rerr.Error() != msg {
+		t.Errorf("incorrect error message: %q. expected: %q", rerr.Error(), msg)
+	}
 }
 
 func TestDecodeInt(t *testing.T) {
@@ -44,6 +167,153 @@ func TestDecodeInt(t *testing.T) {
 	}
 }
 
+func TestDecodeBigInt(t *testing.T) {
+	tests := []struct {
+		input []byte
+		want  int64
+	}{
+		{input: []byte{131, 110, 4, 0, 0, 0, 0, 128}, want: 2147483648},
+		{input: []byte{131, 110, 4, 1, 1, 0, 0, 128}, want: -2147483649},
+		{input: []byte{131, 110, 7, 0, 0, 208, 18, 245, 91, 143, 5}, want: 1565000000000000},
+		{input: []byte{131, 111, 0, 0, 0, 2, 1, 0, 1}, want: -256},
+	}
+
+	for _, tc := range tests {
+		var i int64
+		if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &i); err != nil {
+			t.Errorf("cannot decode Erlang term: %s", err)
+			return
+		}
+
+		if i != tc.want {
+			t.Errorf("incorrect decoded value: %d. expected: %d", i, tc.want)
+		}
+	}
+}
+
+func TestDecodeBigIntRange(t *testing.T) {
+	// 18446744073709551615 does not fit in int64, but fits in uint64
+	input := []byte{131, 110, 8, 0, 255, 255, 255, 255, 255, 255, 255, 255}
+
+	var i int64
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer(input), &i), "erlang number 18446744073709551615 overflows int64")
+
+	var u uint64
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &u); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if u != 18446744073709551615 {
+		t.Errorf("incorrect decoded value: %d", u)
+	}
+
+	// Negative values do not fit in uint64
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer([]byte{131, 98, 255, 255, 255, 255}), &u), "erlang number -1 overflows uint64")
+}
+
+func TestDecodeToBigInt(t *testing.T) {
+	want, _ := new(big.Int).SetString("-340282366920938463463374607431768211456", 10)
+	data, err := bertrpc.Encode(want)
+	if err != nil {
+		t.Errorf("cannot encode big integer: %s", err)
+		return
+	}
+
+	var i *big.Int
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &i); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if i.Cmp(want) != 0 {
+		t.Errorf("incorrect decoded value: %s. expected: %s", i, want)
+	}
+
+	// Small integers can also be decoded to big.Int
+	var small big.Int
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 97, 42}), &small); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if small.Int64() != 42 {
+		t.Errorf("incorrect decoded value: %s", &small)
+	}
+}
+
+func TestDecodeFloat(t *testing.T) {
+	// Legacy FLOAT_EXT is a 31 bytes string padded with zeros
+	legacy := append([]byte{131, 99}, []byte("3.14000000000000012434e+00")...)
+	legacy = append(legacy, make([]byte, 31-26)...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  float64
+	}{
+		{name: "new float", input: []byte{131, 70, 64, 9, 30, 184, 81, 235, 133, 31}, want: 3.14},
+		{name: "negative", input: []byte{131, 70, 191, 224, 0, 0, 0, 0, 0, 0}, want: -0.5},
+		{name: "legacy float", input: legacy, want: 3.14},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var f float64
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &f); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if f != tc.want {
+				st.Errorf("incorrect decoded value: %v. expected: %v", f, tc.want)
+			}
+
+			var f32 float32
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &f32); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if f32 != float32(tc.want) {
+				st.Errorf("incorrect decoded value: %v. expected: %v", f32, float32(tc.want))
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidFloat(t *testing.T) {
+	legacy := func(str string) []byte {
+		data := append([]byte{131, 99}, str...)
+		return append(data, make([]byte, 31-len(str))...)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "legacy nan", input: legacy("nan")},
+		{name: "legacy inf", input: legacy("inf")},
+		{name: "legacy negative infinity", input: legacy("-Infinity")},
+		{name: "nan", input: []byte{131, 70, 127, 248, 0, 0, 0, 0, 0, 1}},
+		{name: "inf", input: []byte{131, 70, 127, 240, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var f float64
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &f); err == nil {
+				st.Errorf("decoding an invalid float should fail, got %v", f)
+			}
+			var term interface{}
+			if err := bertrpc.Unmarshal(tc.input, &term); err == nil {
+				st.Errorf("decoding an invalid float should fail, got %v", term)
+			}
+		})
+	}
+}
+
+func TestDecodeFloat32Range(t *testing.T) {
+	// 1.0e300
+	input := []byte{131, 70, 126, 55, 228, 60, 136, 0, 117, 156}
+	var f float32
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer(input), &f), "erlang number 1e+300 overflows float32")
+}
+
 // TODO: Implement decode same types to []byte and bert.Atom
 func TestDecodeToString(t *testing.T) {
 	longUTF8 := strings.Repeat("🖖", 64)
@@ -75,6 +345,278 @@ func TestDecodeToString(t *testing.T) {
 	}
 }
 
+func TestDecodeSlice(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []int
+	}{
+		{name: "list", input: []byte{131, 108, 0, 0, 0, 3, 97, 1, 98, 0, 0, 1, 0, 97, 3, 106}, want: []int{1, 256, 3}},
+		{name: "string", input: []byte{131, 107, 0, 3, 1, 2, 3}, want: []int{1, 2, 3}},
+		{name: "nil", input: []byte{131, 106}, want: []int{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var res []int
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &res); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(res, tc.want) {
+				st.Errorf("incorrect result: %#v (!= %#v)", res, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStringToBytes(t *testing.T) {
+	// "Hello", as optimized by Erlang with STRING_EXT
+	input := []byte{131, 107, 0, 5, 72, 101, 108, 108, 111}
+
+	var res []byte
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if string(res) != "Hello" {
+		t.Errorf("incorrect result: %v", res)
+	}
+}
+
+func TestDecodeBinaryToBytes(t *testing.T) {
+	input := []byte{131, 109, 0, 0, 0, 4, 1, 2, 3, 4}
+
+	var res []byte
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !bytes.Equal(res, []byte{1, 2, 3, 4}) {
+		t.Errorf("incorrect result: %v", res)
+	}
+
+	var array [4]byte
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &array); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if array != [4]byte{1, 2, 3, 4} {
+		t.Errorf("incorrect result: %v", array)
+	}
+}
+
+type octet uint8
+
+func TestDecodeBinaryToNamedBytes(t *testing.T) {
+	// <<1, 2, 3, 4>> as BINARY_EXT and BIT_BINARY_EXT
+	for _, input := range [][]byte{
+		{131, 109, 0, 0, 0, 4, 1, 2, 3, 4},
+		{131, 77, 0, 0, 0, 4, 8, 1, 2, 3, 4},
+	} {
+		var res []octet
+		if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+			t.Errorf("cannot decode Erlang term: %s", err)
+			return
+		}
+		if !reflect.DeepEqual(res, []octet{1, 2, 3, 4}) {
+			t.Errorf("incorrect result: %v", res)
+		}
+
+		var array [4]octet
+		if err := bertrpc.Unmarshal(input, &array); err != nil {
+			t.Errorf("cannot decode Erlang term: %s", err)
+			return
+		}
+		if array != [4]octet{1, 2, 3, 4} {
+			t.Errorf("incorrect result: %v", array)
+		}
+	}
+}
+
+func TestDecodeBitString(t *testing.T) {
+	// <<1, 2:3>>
+	input := []byte{131, 77, 0, 0, 0, 2, 3, 1, 64}
+	want := bertrpc.BitString{Bytes: []byte{1, 64}, Bits: 3}
+
+	var b bertrpc.BitString
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &b); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", b, want)
+	}
+	if b.BitLen() != 11 {
+		t.Errorf("incorrect bit length: %d", b.BitLen())
+	}
+
+	var term interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &term); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(term, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", term, want)
+	}
+
+	// Bitstrings do not fit in a byte slice
+	var data []byte
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &data); err == nil {
+		t.Errorf("decoding a bitstring to []byte should fail")
+	}
+
+	// Binaries are bitstrings
+	if err := bertrpc.Decode(bytes.NewBuffer([]byte{131, 109, 0, 0, 0, 1, 42}), &b); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(b, bertrpc.BitString{Bytes: []byte{42}, Bits: 8}) {
+		t.Errorf("incorrect result: %#v", b)
+	}
+}
+
+func TestDecodeImproperList(t *testing.T) {
+	// [<<"a">>, "b" | <<"c">>], an iolist with a binary tail
+	input := []byte{131, 108, 0, 0, 0, 2, 109, 0, 0, 0, 1, 97, 107, 0, 1, 98, 109, 0, 0, 0, 1, 99}
+	want := bertrpc.ImproperList{
+		Elems: []interface{}{[]byte("a"), bertrpc.List{int64(98)}},
+		Tail:  []byte("c"),
+	}
+
+	var list bertrpc.ImproperList
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &list); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", list, want)
+	}
+
+	var term interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &term); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(term, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", term, want)
+	}
+
+	data, err := bertrpc.Encode(term)
+	if err != nil {
+		t.Errorf("cannot encode improper list: %s", err)
+		return
+	}
+	// Charlist "b" is encoded as a regular list
+	expected := []byte{131, 108, 0, 0, 0, 2, 109, 0, 0, 0, 1, 97, 108, 0, 0, 0, 1, 97, 98, 106, 109, 0, 0, 0, 1, 99}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("incorrect encoding: %v (!= %v)", data, expected)
+	}
+}
+
+func TestDecodeProperListToImproperList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  bertrpc.ImproperList
+	}{
+		// []
+		{name: "empty list", input: []byte{131, 106},
+			want: bertrpc.ImproperList{Elems: []interface{}{}, Tail: bertrpc.List{}}},
+		// "ab"
+		{name: "string", input: []byte{131, 107, 0, 2, 97, 98},
+			want: bertrpc.ImproperList{Elems: []interface{}{int64(97), int64(98)}, Tail: bertrpc.List{}}},
+		// [a]
+		{name: "list", input: []byte{131, 108, 0, 0, 0, 1, 119, 1, 97, 106},
+			want: bertrpc.ImproperList{Elems: []interface{}{bertrpc.A("a")}, Tail: bertrpc.List{}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var list bertrpc.ImproperList
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &list); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(list, tc.want) {
+				st.Errorf("incorrect result: %#v (!= %#v)", list, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeImproperListError(t *testing.T) {
+	// [a | b]
+	input := []byte{131, 108, 0, 0, 0, 1, 119, 1, 97, 119, 1, 98}
+
+	var list []string
+	err := bertrpc.Decode(bytes.NewBuffer(input), &list)
+	if err == nil {
+		t.Errorf("decoding an improper list to a slice should fail")
+		return
+	}
+	if !strings.Contains(err.Error(), "improper list with tail SmallAtomUTF b") {
+		t.Errorf("error does not describe the list tail: %s", err)
+	}
+}
+
+func TestDecodeStructSlice(t *testing.T) {
+	type user struct {
+		Record string
+		Name   string
+		Age    int
+	}
+	// [{user, <<"john">>, 42}, {user, <<"jane">>, 40}]
+	input := []byte{131, 108, 0, 0, 0, 2,
+		104, 3, 119, 4, 117, 115, 101, 114, 109, 0, 0, 0, 4, 106, 111, 104, 110, 97, 42,
+		104, 3, 119, 4, 117, 115, 101, 114, 109, 0, 0, 0, 4, 106, 97, 110, 101, 97, 40,
+		106}
+	want := []user{{"user", "john", 42}, {"user", "jane", 40}}
+
+	var res []user
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", res, want)
+	}
+}
+
+func TestDecodeStringSlice(t *testing.T) {
+	// [<<"a">>, b, "c"]
+	input := []byte{131, 108, 0, 0, 0, 3, 109, 0, 0, 0, 1, 97, 119, 1, 98, 107, 0, 1, 99, 106}
+	want := []string{"a", "b", "c"}
+
+	var res []string
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", res, want)
+	}
+}
+
+func TestDecodeArray(t *testing.T) {
+	// [1, 2]
+	input := []byte{131, 108, 0, 0, 0, 2, 97, 1, 97, 2, 106}
+
+	var res [2]int
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if res != [2]int{1, 2} {
+		t.Errorf("incorrect result: %v", res)
+	}
+
+	var short [3]int
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &short); err == nil {
+		t.Errorf("decoding list into array with a different length should fail")
+	}
+}
+
 func TestDecodeEmptyTuple(t *testing.T) {
 	input := []byte{131, 104, 0}
 	want := struct{}{}
@@ -130,6 +672,36 @@ func TestFailOnLengthMismatch(t *testing.T) {
 	}
 }
 
+func TestDecodeRecord(t *testing.T) {
+	type user struct {
+		_      struct{} `erlang:"record=user"`
+		Name   string
+		Status string `erlang:",atom"`
+		Cache  string `erlang:"-"`
+	}
+
+	data, err := bertrpc.Encode(user{Name: "john", Status: "online"})
+	if err != nil {
+		t.Errorf("cannot encode record: %s", err)
+		return
+	}
+	var res user
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if res != (user{Name: "john", Status: "online"}) {
+		t.Errorf("incorrect result: %#v", res)
+	}
+
+	// {group, <<"john">>, online}
+	input := []byte{131, 104, 3, 119, 5, 103, 114, 111, 117, 112, 109, 0, 0, 0, 4, 106, 111, 104, 110,
+		119, 6, 111, 110, 108, 105, 110, 101}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err == nil {
+		t.Errorf("decoding a record with a different name should fail")
+	}
+}
+
 type result1 struct {
 	Tag    string `erlang:"tag"`
 	Result string `erlang:"tag:ok"`
@@ -175,6 +747,16 @@ func TestDecodeResult(t *testing.T) {
 	}
 }
 
+func TestDecodeResultLengthMismatch(t *testing.T) {
+	// {ok, found, extra}
+	input := []byte{131, 104, 3, 100, 0, 2, 111, 107, 100, 0, 5, 102, 111, 117, 110, 100, 97, 1}
+
+	var res result1
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err == nil {
+		t.Errorf("decoding a tagged tuple with more values than tagged fields should fail")
+	}
+}
+
 func TestDecodeTupleResult(t *testing.T) {
 	input := []byte{131, 104, 4, 97, 1, 97, 2, 97, 3, 97, 4}
 	want := struct {
@@ -230,3 +812,752 @@ func TestDecodeAtomVsString(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeMap(t *testing.T) {
+	// #{a => 1, <<"b">> => 2}
+	input := []byte{131, 116, 0, 0, 0, 2, 100, 0, 1, 97, 97, 1, 109, 0, 0, 0, 1, 98, 97, 2}
+	want := map[string]int{"a": 1, "b": 2}
+
+	var m map[string]int
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &m); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("incorrect decoded value: %v. expected: %v", m, want)
+	}
+}
+
+func TestDecodeMapUnhashableKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		// #{<<"a">> => 1}
+		{name: "binary key", input: []byte{131, 116, 0, 0, 0, 1, 109, 0, 0, 0, 1, 97, 97, 1},
+			err: "cannot use []uint8 as map key in map[interface {}]interface {}: decode to Map instead"},
+		// #{{1, 2} => 1}
+		{name: "tuple key", input: []byte{131, 116, 0, 0, 0, 1, 104, 2, 97, 1, 97, 2, 97, 1},
+			err: "cannot use bertrpc.Tuple as map key in map[interface {}]interface {}: decode to Map instead"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var m map[interface{}]interface{}
+			err := bertrpc.Decode(bytes.NewBuffer(tc.input), &m)
+			if err == nil || err.Error() != tc.err {
+				st.Errorf("unexpected error: %v. expected: %s", err, tc.err)
+			}
+
+			var generic bertrpc.Map
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &generic); err != nil {
+				st.Errorf("cannot decode Erlang term to Map: %s", err)
+			}
+		})
+	}
+
+	// Hashable keys can still be decoded to interface{} keys
+	// #{a => 1, 2 => 3}
+	input := []byte{131, 116, 0, 0, 0, 2, 119, 1, 97, 97, 1, 97, 2, 97, 3}
+	var m map[interface{}]interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &m); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	want := map[interface{}]interface{}{bertrpc.A("a"): int64(1), int64(2): int64(3)}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("incorrect decoded value: %#v. expected: %#v", m, want)
+	}
+}
+
+func TestDecodeMapToInterface(t *testing.T) {
+	// #{name => <<"john">>, age => 42, roles => [admin]}
+	input := []byte{131, 116, 0, 0, 0, 3, 119, 4, 110, 97, 109, 101, 109, 0, 0, 0, 4, 106, 111, 104, 110,
+		119, 3, 97, 103, 101, 97, 42, 119, 5, 114, 111, 108, 101, 115, 108, 0, 0, 0, 1, 119, 5, 97, 100, 109,
+		105, 110, 106}
+	want := map[string]interface{}{
+		"name":  []byte("john"),
+		"age":   int64(42),
+		"roles": bertrpc.List{bertrpc.A("admin")},
+	}
+
+	var m map[string]interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &m); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("incorrect decoded value: %#v. expected: %#v", m, want)
+	}
+}
+
+func TestDecodeMapToStruct(t *testing.T) {
+	type user struct {
+		Name  string
+		Email string `erlang:"mail"`
+		Age   int
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  user
+	}{
+		// #{name => <<"john">>, mail => <<"j@d">>, age => 42}
+		{name: "atom keys", input: []byte{131, 116, 0, 0, 0, 3, 119, 4, 110, 97, 109, 101, 109, 0, 0, 0, 4, 106, 111,
+			104, 110, 119, 4, 109, 97, 105, 108, 109, 0, 0, 0, 3, 106, 64, 100, 119, 3, 97, 103, 101, 97, 42},
+			want: user{Name: "john", Email: "j@d", Age: 42}},
+		// #{<<"Name">> => <<"john">>, <<"mail">> => <<"j@d">>}
+		{name: "binary keys", input: []byte{131, 116, 0, 0, 0, 2, 109, 0, 0, 0, 4, 78, 97, 109, 101, 109, 0, 0, 0, 4,
+			106, 111, 104, 110, 109, 0, 0, 0, 4, 109, 97, 105, 108, 109, 0, 0, 0, 3, 106, 64, 100},
+			want: user{Name: "john", Email: "j@d"}},
+		// #{<<"name">> => <<"john">>, <<"Mail">> => <<"j@d">>}: tag names are case sensitive
+		{name: "case folding", input: []byte{131, 116, 0, 0, 0, 2, 109, 0, 0, 0, 4, 110, 97, 109, 101, 109, 0, 0, 0, 4,
+			106, 111, 104, 110, 109, 0, 0, 0, 4, 77, 97, 105, 108, 109, 0, 0, 0, 3, 106, 64, 100},
+			want: user{Name: "john"}},
+		// #{age => 42, extra => {1, 2}}
+		{name: "unknown key", input: []byte{131, 116, 0, 0, 0, 2, 119, 3, 97, 103, 101, 97, 42, 119, 5, 101, 120, 116,
+			114, 97, 104, 2, 97, 1, 97, 2},
+			want: user{Age: 42}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var res user
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &res); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+
+			if res != tc.want {
+				st.Errorf("incorrect result: %#v (!= %#v)", res, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeInterface(t *testing.T) {
+	// {ok, [1, 3.5, <<"bin">>, "ab", []], #{key => 70000000000}}
+	input := []byte{131, 104, 3, 119, 2, 111, 107,
+		108, 0, 0, 0, 5, 97, 1, 70, 64, 12, 0, 0, 0, 0, 0, 0, 109, 0, 0, 0, 3, 98, 105, 110, 107, 0, 2, 97, 98, 106, 106,
+		116, 0, 0, 0, 1, 119, 3, 107, 101, 121, 110, 5, 0, 0, 60, 83, 76, 16}
+	want := bertrpc.T(
+		bertrpc.A("ok"),
+		bertrpc.List{int64(1), 3.5, []byte("bin"), bertrpc.List{int64(97), int64(98)}, bertrpc.List{}},
+		bertrpc.Map{{Key: bertrpc.A("key"), Value: int64(70000000000)}},
+	)
+
+	var res interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("incorrect result: %#v (!= %#v)", res, want)
+	}
+
+	m := res.(bertrpc.Tuple).Elems[2].(bertrpc.Map)
+	if v, ok := m.Get(bertrpc.A("key")); !ok || v != int64(70000000000) {
+		t.Errorf("cannot get value from decoded map: %v", v)
+	}
+}
+
+// Generic terms can be encoded back to Erlang unchanged
+func TestInterfaceRoundTrip(t *testing.T) {
+	// {ok, [1, 3.5, <<"bin">>, -2147483649, []], #{key => {}}}
+	input := []byte{131, 104, 3, 119, 2, 111, 107,
+		108, 0, 0, 0, 5, 97, 1, 70, 64, 12, 0, 0, 0, 0, 0, 0, 109, 0, 0, 0, 3, 98, 105, 110, 110, 4, 1, 1, 0, 0, 128,
+		106, 106, 116, 0, 0, 0, 1, 119, 3, 107, 101, 121, 104, 0}
+
+	var res interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+
+	data, err := bertrpc.Encode(res)
+	if err != nil {
+		t.Errorf("cannot encode decoded term: %s", err)
+		return
+	}
+	if !bytes.Equal(data, input) {
+		t.Errorf("incorrect encoding: %v (!= %v)", data, input)
+	}
+}
+
+func TestMapRoundTrip(t *testing.T) {
+	m := map[string]interface{}{
+		"list":  bertrpc.List{int64(1), int64(2)},
+		"tuple": bertrpc.T(bertrpc.A("ok"), []byte("done")),
+		"map":   bertrpc.Map{{Key: bertrpc.A("key"), Value: int64(-10)}},
+	}
+	data, err := bertrpc.Encode(m)
+	if err != nil {
+		t.Errorf("cannot encode map: %s", err)
+		return
+	}
+
+	var res map[string]interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(res, m) {
+		t.Errorf("incorrect result: %#v (!= %#v)", res, m)
+	}
+}
+
+func TestDecodeIdentifiers(t *testing.T) {
+	node := []byte{100, 0, 13, 110, 111, 110, 111, 100, 101, 64, 110, 111, 104, 111, 115, 116} // nonode@nohost
+	pid := bertrpc.Pid{Node: "nonode@nohost", ID: 123, Serial: 1, Creation: 2}
+	port := bertrpc.Port{Node: "nonode@nohost", ID: 42, Creation: 2}
+	ref := bertrpc.Ref{Node: "nonode@nohost", Creation: 2, ID: []uint32{1, 2, 3}}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  interface{}
+	}{
+		{name: "new pid", input: bytes.Join([][]byte{{131, 88}, node, {0, 0, 0, 123, 0, 0, 0, 1, 0, 0, 0, 2}}, nil), want: pid},
+		{name: "legacy pid", input: bytes.Join([][]byte{{131, 103}, node, {0, 0, 0, 123, 0, 0, 0, 1, 2}}, nil), want: pid},
+		{name: "new port", input: bytes.Join([][]byte{{131, 89}, node, {0, 0, 0, 42, 0, 0, 0, 2}}, nil), want: port},
+		{name: "v4 port", input: bytes.Join([][]byte{{131, 120}, node, {0, 0, 0, 0, 0, 0, 0, 42, 0, 0, 0, 2}}, nil), want: port},
+		{name: "legacy port", input: bytes.Join([][]byte{{131, 102}, node, {0, 0, 0, 42, 2}}, nil), want: port},
+		{name: "newer ref", input: bytes.Join([][]byte{{131, 90, 0, 3}, node, {0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}}, nil),
+			want: ref},
+		{name: "new ref", input: bytes.Join([][]byte{{131, 114, 0, 3}, node, {2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}}, nil), want: ref},
+		{name: "legacy ref", input: bytes.Join([][]byte{{131, 101}, node, {0, 0, 0, 1, 2}}, nil),
+			want: bertrpc.Ref{Node: "nonode@nohost", Creation: 2, ID: []uint32{1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			// Decode to the matching Go type
+			res := reflect.New(reflect.TypeOf(tc.want))
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), res.Interface()); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(res.Elem().Interface(), tc.want) {
+				st.Errorf("incorrect result: %#v (!= %#v)", res.Elem().Interface(), tc.want)
+			}
+
+			// Decode as generic term
+			var term interface{}
+			if err := bertrpc.Decode(bytes.NewBuffer(tc.input), &term); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(term, tc.want) {
+				st.Errorf("incorrect result: %#v (!= %#v)", term, tc.want)
+			}
+		})
+	}
+}
+
+func TestIdentifiersString(t *testing.T) {
+	tests := []struct {
+		term fmt.Stringer
+		want string
+	}{
+		{bertrpc.Pid{Node: "nonode@nohost", ID: 123}, "<0.123.0>"},
+		{bertrpc.Port{Node: "nonode@nohost", ID: 42}, "#Port<0.42>"},
+		{bertrpc.Ref{Node: "nonode@nohost", ID: []uint32{105563, 3429089282, 1776403624}}, "#Ref<0.1776403624.3429089282.105563>"},
+	}
+
+	for _, tc := range tests {
+		if s := tc.term.String(); s != tc.want {
+			t.Errorf("incorrect string: %s (!= %s)", s, tc.want)
+		}
+	}
+}
+
+func TestDecodeExport(t *testing.T) {
+	// fun lists:reverse/1, with old style atoms
+	input := []byte{131, 113, 100, 0, 5, 108, 105, 115, 116, 115, 100, 0, 7, 114, 101, 118, 101, 114, 115, 101, 97, 1}
+	want := bertrpc.Export{Module: "lists", Function: "reverse", Arity: 1}
+
+	var e bertrpc.Export
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &e); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if e != want {
+		t.Errorf("incorrect result: %#v (!= %#v)", e, want)
+	}
+	if e.String() != "fun lists:reverse/1" {
+		t.Errorf("incorrect string: %s", e)
+	}
+}
+
+// funTerm returns fun(X) -> X + Y end, with Y = 42, defined in the shell.
+func funTerm() []byte {
+	uniq := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	content := bytes.Join([][]byte{
+		{1},          // Arity
+		uniq,         // Uniq
+		{0, 0, 0, 5}, // Index
+		{0, 0, 0, 1}, // NumFree
+		{119, 8, 101, 114, 108, 95, 101, 118, 97, 108}, // Module: erl_eval
+		{97, 5},              // OldIndex
+		{98, 7, 91, 205, 21}, // OldUniq
+		{88, 119, 13, 110, 111, 110, 111, 100, 101, 64, 110, 111, 104, 111, 115, 116, 0, 0, 0, 80, 0, 0, 0, 0, 0, 0, 0, 0}, // Pid
+		{100, 0, 1, 89}, // Free variable, with old style atom: 'Y'
+	}, nil)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(content)+4))
+	return bytes.Join([][]byte{{131, 112}, size, content}, nil)
+}
+
+func TestFunRoundTrip(t *testing.T) {
+	input := funTerm()
+
+	var term interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(input), &term); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	f, ok := term.(bertrpc.Fun)
+	if !ok {
+		t.Errorf("incorrect decoded type: %T", term)
+		return
+	}
+	if f.Module != "erl_eval" || f.Arity != 1 || f.Index != 5 || f.OldUniq != 123456789 {
+		t.Errorf("incorrect fun: %#v", f)
+	}
+	if f.Pid.ID != 80 {
+		t.Errorf("incorrect fun creator pid: %s", f.Pid)
+	}
+	if !reflect.DeepEqual(f.FreeVars, []interface{}{bertrpc.A("Y")}) {
+		t.Errorf("incorrect free variables: %#v", f.FreeVars)
+	}
+
+	// Encoding gives back the same bytes
+	data, err := bertrpc.Encode(bertrpc.T(f))
+	if err != nil {
+		t.Errorf("cannot encode fun: %s", err)
+		return
+	}
+	if !bytes.Equal(data[3:], input[1:]) {
+		t.Errorf("incorrect encoding: %v (!= %v)", data[3:], input[1:])
+	}
+}
+
+func TestDecodeCompressed(t *testing.T) {
+	// [1, 2, 3] as a string
+	term := []byte{107, 0, 3, 1, 2, 3}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	_, _ = zw.Write(term)
+	_ = zw.Close()
+
+	tests := []struct {
+		name    string
+		size    byte
+		wantErr bool
+	}{
+		{name: "valid", size: 6},
+		{name: "announced size too large", size: 7, wantErr: true},
+		{name: "announced size too small", size: 5, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			input := append([]byte{131, 80, 0, 0, 0, tc.size}, z.Bytes()...)
+
+			var res []int
+			err := bertrpc.Decode(bytes.NewBuffer(input), &res)
+			if tc.wantErr {
+				if err == nil {
+					st.Errorf("decoding a compressed term with incorrect size should fail")
+				}
+				return
+			}
+			if err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(res, []int{1, 2, 3}) {
+				st.Errorf("incorrect result: %v", res)
+			}
+		})
+	}
+}
+
+// rosterItem is a typical ejabberd roster item, in map form.
+type rosterItem struct {
+	_            struct{} `erlang:"map"`
+	JID          []byte   `erlang:"jid"`
+	Name         string   `erlang:"name"`
+	Subscription string   `erlang:"subscription,atom"`
+	Groups       [][]byte `erlang:"groups"`
+}
+
+func rosterTerm(tb testing.TB, size int) []byte {
+	items := make([]rosterItem, size)
+	for i := range items {
+		items[i] = rosterItem{
+			JID:          []byte(fmt.Sprintf("user%d@localhost", i)),
+			Name:         fmt.Sprintf("User %d", i),
+			Subscription: "both",
+			Groups:       [][]byte{[]byte("Friends"), []byte("Work")},
+		}
+	}
+	data, err := bertrpc.Encode(items)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestUnmarshal(t *testing.T) {
+	data := rosterTerm(t, 3)
+
+	var fromReader, fromMemory []rosterItem
+	if err := bertrpc.Decode(bytes.NewReader(data), &fromReader); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	if err := bertrpc.Unmarshal(data, &fromMemory); err != nil {
+		t.Fatalf("cannot unmarshal Erlang term: %s", err)
+	}
+	if !reflect.DeepEqual(fromReader, fromMemory) {
+		t.Errorf("Unmarshal and Decode results differ: %v, %v", fromReader, fromMemory)
+	}
+
+	var term, expected interface{}
+	if err := bertrpc.Decode(bytes.NewReader(data), &expected); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	if err := bertrpc.Unmarshal(data, &term); err != nil {
+		t.Fatalf("cannot unmarshal Erlang term: %s", err)
+	}
+	if !reflect.DeepEqual(term, expected) {
+		t.Errorf("Unmarshal and Decode results differ: %v, %v", expected, term)
+	}
+}
+
+func TestUnmarshalCompressed(t *testing.T) {
+	list := make([]int, 100)
+	data, err := bertrpc.EncodeWithOptions(list, bertrpc.EncodeOptions{CompressionLevel: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []int
+	if err := bertrpc.Unmarshal(data, &res); err != nil {
+		t.Fatalf("cannot unmarshal compressed term: %s", err)
+	}
+	if !reflect.DeepEqual(res, list) {
+		t.Errorf("incorrect result: %v", res)
+	}
+}
+
+func TestUnmarshalAliasBytes(t *testing.T) {
+	// {<<"abc">>, <<"def">>}
+	data := []byte{131, 104, 2, 109, 0, 0, 0, 3, 97, 98, 99, 109, 0, 0, 0, 3, 100, 101, 102}
+
+	var res struct {
+		B []byte
+		I interface{}
+	}
+	if err := bertrpc.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	copied := res
+	if err := bertrpc.UnmarshalWithOptions(data, &res, bertrpc.DecodeOptions{AliasBytes: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aliased binaries reflect changes made to the input
+	data[8], data[16] = 'x', 'y'
+	if string(copied.B) != "abc" || string(copied.I.([]byte)) != "def" {
+		t.Errorf("binaries should be copied by default: %q, %q", copied.B, copied.I)
+	}
+	if string(res.B) != "xbc" || string(res.I.([]byte)) != "yef" {
+		t.Errorf("binaries should alias the input: %q, %q", res.B, res.I)
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	data := rosterTerm(t, 2)
+	for i := 0; i < len(data); i++ {
+		var term interface{}
+		if err := bertrpc.Unmarshal(data[:i], &term); err == nil {
+			t.Errorf("unmarshalling term truncated to %d bytes should fail", i)
+		}
+	}
+}
+
+func TestInvalidDecodeTarget(t *testing.T) {
+	data := []byte{131, 97, 42}
+	// {reply, 42}
+	reply := []byte{0, 0, 0, 11, 131, 104, 2, 119, 5, 114, 101, 112, 108, 121, 97, 42}
+	decoders := []struct {
+		name   string
+		decode func(term interface{}) error
+	}{
+		{"Unmarshal", func(term interface{}) error { return bertrpc.Unmarshal(data, term) }},
+		{"Decode", func(term interface{}) error { return bertrpc.Decode(bytes.NewReader(data), term) }},
+		{"Decoder.Decode", func(term interface{}) error { return bertrpc.NewDecoder(bytes.NewReader(data)).Decode(term) }},
+		{"DecodeReply", func(term interface{}) error { return bertrpc.DecodeReply(bytes.NewReader(reply), term) }},
+	}
+	var i int
+	var p *int
+	tests := []struct {
+		target interface{}
+		err    string
+	}{
+		{nil, "cannot decode to nil"},
+		{i, "cannot decode to non-pointer int"},
+		{p, "cannot decode to nil *int"},
+	}
+
+	for _, dec := range decoders {
+		t.Run(dec.name, func(st *testing.T) {
+			for _, tc := range tests {
+				err := dec.decode(tc.target)
+				if _, ok := err.(*bertrpc.InvalidUnmarshalError); !ok || err.Error() != tc.err {
+					st.Errorf("unexpected error: %v. expected: %s", err, tc.err)
+				}
+			}
+			var res int
+			if err := dec.decode(&res); err != nil || res != 42 {
+				st.Errorf("cannot decode to a pointer: %d, %v", res, err)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := rosterTerm(b, 100)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var items []rosterItem
+		if err := bertrpc.Decode(bytes.NewReader(data), &items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data := rosterTerm(b, 100)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var items []rosterItem
+		if err := bertrpc.Unmarshal(data, &items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalAliasBytes(b *testing.B) {
+	data := rosterTerm(b, 100)
+	opts := bertrpc.DecodeOptions{AliasBytes: true}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var items []rosterItem
+		if err := bertrpc.UnmarshalWithOptions(data, &items, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// allTags returns a term using every supported tag, with legacy encodings that
+// would not be produced back by Encode.
+func allTags(tb testing.TB) []byte {
+	bigInt, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	data, err := bertrpc.Encode(bertrpc.T(
+		1, 1000, bigInt, 1.5, bertrpc.A("atom"), "binary",
+		bertrpc.BitString{Bytes: []byte{255, 128}, Bits: 1},
+		bertrpc.Pid{Node: "nonode@nohost", ID: 80},
+		bertrpc.Port{Node: "nonode@nohost", ID: 1 << 40},
+		bertrpc.Ref{Node: "nonode@nohost", ID: []uint32{1, 2, 3}},
+		bertrpc.Export{Module: "lists", Function: "map", Arity: 2},
+		bertrpc.ImproperList{Elems: []interface{}{1}, Tail: 2},
+		bertrpc.Map{{Key: 1, Value: bertrpc.L()}},
+	))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	legacy := [][]byte{
+		{100, 0, 1, 89},                       // Latin-1 atom
+		{107, 0, 2, 104, 105},                 // String
+		{99, 49, 46, 53, 48, 101, 43, 48, 48}, // Float, padded below
+	}
+	legacy[2] = append(legacy[2], make([]byte, 31-8)...)
+	// Increase the tuple arity, and append the legacy terms
+	data[2] += byte(len(legacy))
+	return append(data, bytes.Join(legacy, nil)...)
+}
+
+func TestDecodeRawTerm(t *testing.T) {
+	payload := allTags(t)
+	// {reply, Payload}
+	input := append([]byte{131, 104, 2, 119, 5, 114, 101, 112, 108, 121}, payload[1:]...)
+
+	var res struct {
+		Tag     string
+		Payload bertrpc.RawTerm
+	}
+	if err := bertrpc.Decode(iotest.OneByteReader(bytes.NewReader(input)), &res); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	if !bytes.Equal(res.Payload, payload) {
+		t.Errorf("incorrect raw term: expected %v, actual %v", payload, res.Payload)
+	}
+
+	res.Payload = nil
+	if err := bertrpc.Unmarshal(input, &res); err != nil {
+		t.Fatalf("cannot unmarshal Erlang term: %s", err)
+	}
+	if !bytes.Equal(res.Payload, payload) {
+		t.Errorf("incorrect raw term: expected %v, actual %v", payload, res.Payload)
+	}
+
+	// The raw term can then be decoded
+	var term interface{}
+	if err := bertrpc.Unmarshal(res.Payload, &term); err != nil {
+		t.Errorf("cannot unmarshal raw term: %s", err)
+	}
+}
+
+func TestDecodeRawTermInTupleAndList(t *testing.T) {
+	// {ok, [1, {a}]}
+	input := []byte{131, 104, 2, 119, 2, 111, 107, 108, 0, 0, 0, 2, 97, 1, 104, 1, 119, 1, 97, 106}
+
+	var tag string
+	var elems []bertrpc.RawTerm
+	tuple := bertrpc.Tuple{Elems: []interface{}{&tag, &elems}}
+	if err := bertrpc.Unmarshal(input, &tuple); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	expected := []bertrpc.RawTerm{{131, 97, 1}, {131, 104, 1, 119, 1, 97}}
+	if tag != "ok" || !reflect.DeepEqual(elems, expected) {
+		t.Errorf("incorrect result: %q, %v", tag, elems)
+	}
+
+	var raw bertrpc.RawTerm
+	list := bertrpc.List{nil, &raw}
+	if err := bertrpc.Unmarshal(input, &bertrpc.Tuple{Elems: []interface{}{nil, &list}}); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	if list[0] != int64(1) || !bytes.Equal(raw, expected[1]) {
+		t.Errorf("incorrect result: %v, %v", list[0], raw)
+	}
+
+	// Generic tuples
+	var generic bertrpc.Tuple
+	if err := bertrpc.Unmarshal(input, &generic); err != nil {
+		t.Fatalf("cannot decode Erlang term: %s", err)
+	}
+	if !reflect.DeepEqual(generic, bertrpc.T(bertrpc.A("ok"), bertrpc.List{int64(1), bertrpc.T(bertrpc.A("a"))})) {
+		t.Errorf("incorrect tuple: %v", generic)
+	}
+}
+
+func TestDecodeBool(t *testing.T) {
+	var values []bool
+	data, err := bertrpc.Encode(bertrpc.List{bertrpc.A("true"), bertrpc.A("false")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bertrpc.Unmarshal(data, &values); err != nil {
+		t.Fatalf("cannot decode bools: %s", err)
+	}
+	if !reflect.DeepEqual(values, []bool{true, false}) {
+		t.Errorf("unexpected bools: %v", values)
+	}
+
+	var b bool
+	for _, term := range []interface{}{bertrpc.A("yes"), 1} {
+		data, err := bertrpc.Encode(term)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bertrpc.Unmarshal(data, &b); err == nil {
+			t.Errorf("decoding %v to bool should fail", term)
+		}
+	}
+}
+
+type pointerFields struct {
+	Name  *string
+	Count *int
+	Tags  *[]string
+	Last  string
+}
+
+// Pointer fields are allocated, or set to nil by the nil atom. Following fields
+// are still decoded.
+func TestDecodePointerFields(t *testing.T) {
+	var tests = []struct {
+		term    interface{}
+		opts    bertrpc.DecodeOptions
+		name    string
+		count   int
+		hasTags bool
+	}{
+		{bertrpc.T("alice", 3, []string{"a"}, "end"), bertrpc.DecodeOptions{}, "alice", 3, true},
+		{bertrpc.T(bertrpc.A("undefined"), 3, bertrpc.A("undefined"), "end"), bertrpc.DecodeOptions{}, "", 3, false},
+		{bertrpc.T(bertrpc.A("nil"), bertrpc.A("nil"), []string{}, "end"), bertrpc.DecodeOptions{NilAtom: "nil"}, "", 0, true},
+		// Other atoms are decoded to the pointed value
+		{bertrpc.T(bertrpc.A("alice"), 3, []string{}, "end"), bertrpc.DecodeOptions{}, "alice", 3, true},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// From memory, and from a stream
+		for _, r := range []io.Reader{nil, iotest.OneByteReader(bytes.NewReader(data))} {
+			// Existing values are replaced
+			name := "previous"
+			res := pointerFields{Name: &name}
+			if r == nil {
+				err = bertrpc.UnmarshalWithOptions(data, &res, tt.opts)
+			} else {
+				dec := bertrpc.NewDecoder(r)
+				dec.SetOptions(tt.opts)
+				err = dec.Decode(&res)
+			}
+			if err != nil {
+				t.Errorf("cannot decode %v: %s", tt.term, err)
+				continue
+			}
+			if (res.Name == nil) != (tt.name == "") || res.Name != nil && *res.Name != tt.name {
+				t.Errorf("decoding %v: unexpected name %v", tt.term, res.Name)
+			}
+			if (res.Count == nil) != (tt.count == 0) || res.Count != nil && *res.Count != tt.count {
+				t.Errorf("decoding %v: unexpected count %v", tt.term, res.Count)
+			}
+			if (res.Tags != nil) != tt.hasTags || res.Last != "end" {
+				t.Errorf("decoding %v: unexpected result %+v", tt.term, res)
+			}
+		}
+	}
+}
+
+func TestDecodeTaggedPointerFields(t *testing.T) {
+	var res struct {
+		Tag    string  `erlang:"tag"`
+		Result *string `erlang:"tag:ok"`
+		Code   *int    `erlang:"tag:ok"`
+	}
+	data, err := bertrpc.Encode(bertrpc.T(bertrpc.A("ok"), bertrpc.A("undefined"), 42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bertrpc.Unmarshal(data, &res); err != nil {
+		t.Fatalf("cannot decode tagged tuple: %s", err)
+	}
+	if res.Tag != "ok" || res.Result != nil || res.Code == nil || *res.Code != 42 {
+		t.Errorf("unexpected tagged tuple: %+v", res)
+	}
+}
@@ -2,15 +2,75 @@ package bertrpc // import "gosrc.io/erlang/bertrpc"
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
+	"time"
 )
 
+// EncodeOptions controls how terms are serialized.
+type EncodeOptions struct {
+	// CompressionLevel is the zlib compression level, from 1 (best speed) to 9 (best compression),
+	// as in Erlang term_to_binary/2 {compressed, Level} option. 0 disables compression.
+	CompressionLevel int
+	// CompressionThreshold is the minimum size in bytes of the encoded term for compression to be applied.
+	// Small terms are not worth compressing.
+	CompressionThreshold int
+	// StringMode selects the Erlang representation of Go strings.
+	StringMode StringMode
+	// Deterministic produces the same encoding as Erlang term_to_binary/2 with the
+	// deterministic option: map keys are sorted in Erlang term order, whatever the map
+	// type, and lists of integers between 0 and 255 use the compact string representation.
+	// Raw terms are re-encoded the same way. Integer, float and atom representations
+	// always match the ones chosen by Erlang.
+	// Compressed data depends on the zlib implementation, so it can still differ.
+	Deterministic bool
+	// NilAtom is the atom nil values and nil pointers are encoded to. It defaults to
+	// DefaultNilAtom. Use "nil" for Elixir.
+	NilAtom string
+}
+
+// DefaultNilAtom is the atom representing nil values when no other atom is set in
+// the options, as undefined is used in Erlang for missing values.
+const DefaultNilAtom = "undefined"
+
+func nilAtom(atom string) string {
+	if atom == "" {
+		return DefaultNilAtom
+	}
+	return atom
+}
+
+// StringMode selects how Go strings are encoded. It does not apply to String values,
+// which carry their own Erlang type.
+type StringMode int
+
+const (
+	// StringBinary encodes strings as UTF-8 binaries, as Elixir strings. This is the default.
+	StringBinary StringMode = iota
+	// StringCharList encodes strings as lists of characters, as Erlang strings.
+	StringCharList
+)
+
+// encodeState holds the buffer the term is written to and the encoding options.
+type encodeState struct {
+	buf  *bytes.Buffer
+	opts EncodeOptions
+}
+
 // Encode serializes a term as a ETF structure
 func Encode(term interface{}) ([]byte, error) {
+	return EncodeWithOptions(term, EncodeOptions{})
+}
+
+// EncodeWithOptions serializes a term as a ETF structure, using the given options.
+func EncodeWithOptions(term interface{}, opts EncodeOptions) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := EncodeTo(term, &buf); err != nil {
+	if err := encodeTo(term, &buf, opts); err != nil {
 		return []byte{}, err
 	}
 	return buf.Bytes(), nil
@@ -19,63 +79,191 @@ func Encode(term interface{}) ([]byte, error) {
 // Use Erlang External Term Format
 // Reference: http://erlang.org/doc/apps/erts/erl_ext_dist.html
 func EncodeTo(term interface{}, buf *bytes.Buffer) error {
+	return encodeTo(term, buf, EncodeOptions{})
+}
+
+func encodeTo(term interface{}, buf *bytes.Buffer, opts EncodeOptions) error {
+	if opts.CompressionLevel < 0 || opts.CompressionLevel > zlib.BestCompression {
+		return fmt.Errorf("invalid compression level: %d", opts.CompressionLevel)
+	}
+
 	// Header for External Erlang Term Format
 	buf.Write([]byte{TagETFVersion})
 
-	// Encode the data
-	if err := encodePayloadTo(term, buf); err != nil {
+	if opts.CompressionLevel == 0 {
+		// Encode the data
+		e := &encodeState{buf: buf, opts: opts}
+		return e.encodePayloadTo(term)
+	}
+
+	var payload bytes.Buffer
+	e := &encodeState{buf: &payload, opts: opts}
+	if err := e.encodePayloadTo(term); err != nil {
+		return err
+	}
+	if payload.Len() < opts.CompressionThreshold {
+		buf.Write(payload.Bytes())
+		return nil
+	}
+	return compressPayload(buf, payload.Bytes(), opts.CompressionLevel)
+}
+
+// compressPayload writes the zlib compressed payload, prefixed with its uncompressed size.
+// Like Erlang, we keep the uncompressed payload if compression does not make it smaller.
+func compressPayload(buf *bytes.Buffer, payload []byte, level int) error {
+	var compressed bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&compressed, level)
+	if err != nil {
 		return err
 	}
+	if _, err := zw.Write(payload); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if compressed.Len()+5 >= len(payload) {
+		buf.Write(payload)
+		return nil
+	}
+	buf.WriteByte(TagCompressed)
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	buf.Write(compressed.Bytes())
 	return nil
 }
 
-func encodePayloadTo(term interface{}, buf *bytes.Buffer) error {
+func (e *encodeState) encodePayloadTo(term interface{}) error {
+	if term == nil {
+		return e.encodeAtom(nilAtom(e.opts.NilAtom))
+	}
+	if v := reflect.ValueOf(term); v.Kind() == reflect.Ptr && v.IsNil() {
+		return e.encodeAtom(nilAtom(e.opts.NilAtom))
+	}
+
+	// Types can define their own Erlang representation
+	if m, ok := marshaler(term); ok {
+		return e.encodeMarshaler(m)
+	}
+
 	var err error
 	switch t := term.(type) {
 
 	case String:
 		if t.ErlangType == StringTypeAtom {
-			err = encodeAtom(buf, t.Value)
+			err = e.encodeAtom(t.Value)
 		} else {
-			err = encodeString(buf, t.Value)
+			err = e.encodeString(t.Value)
 		}
 
 	case string:
-		err = encodeString(buf, t)
+		if e.opts.StringMode == StringCharList {
+			err = e.encodeCharList(t)
+		} else {
+			err = e.encodeString(t)
+		}
+	case CharList:
+		err = e.encodeCharList(t.Value)
+
+	case bool:
+		err = e.encodeBool(t)
+
+	case []byte:
+		err = e.encodeBinary(t)
+	case BitString:
+		err = e.encodeBitString(t)
 
 	case int:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeInt(int64(t))
 	case int8:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeInt(int64(t))
 	case int16:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeInt(int64(t))
 	case int32:
-		err = encodeInt(buf, t)
+		err = e.encodeInt(int64(t))
+	case int64:
+		err = e.encodeInt(t)
 	case uint:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeUint(uint64(t))
 	case uint8:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeUint(uint64(t))
 	case uint16:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeUint(uint64(t))
 	case uint32:
-		err = encodeInt(buf, int32(t))
+		err = e.encodeUint(uint64(t))
+	case uint64:
+		err = e.encodeUint(t)
+	case time.Duration:
+		err = e.encodeInt(int64(t / time.Millisecond))
+	case time.Time:
+		err = fmt.Errorf("cannot encode time.Time without a time representation option")
+
+	case *big.Int:
+		err = e.encodeBigInt(t)
+	case big.Int:
+		err = e.encodeBigInt(&t)
+
+	case float32:
+		err = e.encodeFloat(float64(t))
+	case float64:
+		err = e.encodeFloat(t)
 
 	case Tuple:
-		err = encodeTuple(buf, t)
+		err = e.encodeTuple(t)
+
+	case RawTerm:
+		if err = e.encodeRawTerm(t); err != nil {
+			err = fmt.Errorf("invalid raw term: %v", err)
+		}
+
+	case Map:
+		err = e.encodeMapEntries(t)
+
+	case ImproperList:
+		err = e.encodeImproperList(t)
+
+	case Pid:
+		err = e.encodePid(t)
+	case Port:
+		err = e.encodePort(t)
+	case Ref:
+		err = e.encodeRef(t)
+
+	case Export:
+		err = e.encodeExport(t)
+	case Fun:
+		err = e.encodeFun(t)
 
 	default:
-		// Defines how to encode Go pointer types
+		// Other types, including named types, are encoded according to their kind
 		v := reflect.ValueOf(term)
 		switch v.Kind() {
-		case reflect.Slice:
-			// TODO: handle reflect.Array
+		case reflect.Slice, reflect.Array:
 			var list []interface{}
 			list, err = makeGenericSlice(term)
 			if err != nil {
 				err = fmt.Errorf("error converting slice: %v - %v:\n%v", v.Kind(), v.Type().Name(), err)
 				break
 			}
-			err = encodeList(buf, list)
+			err = e.encodeList(list)
+		case reflect.Map:
+			err = e.encodeMap(v)
+		case reflect.Struct:
+			err = e.encodeStruct(v)
+		case reflect.Bool:
+			err = e.encodeBool(v.Bool())
+		case reflect.String:
+			err = e.encodePayloadTo(v.String())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			err = e.encodeInt(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			err = e.encodeUint(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			err = e.encodeFloat(v.Float())
+		case reflect.Ptr:
+			err = e.encodePayloadTo(v.Elem().Interface())
 		default:
 			err = fmt.Errorf("unhandled type: %v - %v", v.Kind(), v.Type().Name())
 		}
@@ -83,95 +271,564 @@ func encodePayloadTo(term interface{}, buf *bytes.Buffer) error {
 	return err
 }
 
-func encodeAtom(buf *bytes.Buffer, str string) error {
+func (e *encodeState) encodeAtom(str string) error {
 	// Encode atom header
 	if len(str) <= 255 {
 		// Encode small UTF8 atom
-		buf.WriteByte(TagSmallAtomUTF8)
-		buf.WriteByte(byte(len(str)))
+		e.buf.WriteByte(TagSmallAtomUTF8)
+		e.buf.WriteByte(byte(len(str)))
 	} else {
 		// Encode standard UTF8 atom
-		buf.WriteByte(TagAtomUTF8)
-		if err := binary.Write(buf, binary.BigEndian, uint16(len(str))); err != nil {
+		e.buf.WriteByte(TagAtomUTF8)
+		if err := binary.Write(e.buf, binary.BigEndian, uint16(len(str))); err != nil {
 			return err
 		}
 	}
 
 	// Write atom
-	buf.WriteString(str)
+	e.buf.WriteString(str)
 	return nil
 }
 
-func encodeString(buf *bytes.Buffer, str string) error {
-	buf.WriteByte(TagBinary)
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(str))); err != nil {
+// encodeBool encodes a boolean as the atom true or false.
+func (e *encodeState) encodeBool(b bool) error {
+	if b {
+		return e.encodeAtom("true")
+	}
+	return e.encodeAtom("false")
+}
+
+func (e *encodeState) encodeString(str string) error {
+	e.buf.WriteByte(TagBinary)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(str))); err != nil {
 		return err
 	}
-	buf.WriteString(str)
+	e.buf.WriteString(str)
 	return nil
 }
 
-func encodeInt(buf *bytes.Buffer, i int32) error {
-	if i >= 0 && i <= 255 {
-		buf.WriteByte(TagSmallInteger)
-		buf.WriteByte(byte(i))
+// encodeCharList encodes a string as a list of characters. Like Erlang, we use the
+// compact STRING_EXT when all characters fit in a byte.
+func (e *encodeState) encodeCharList(str string) error {
+	runes := []rune(str)
+	if len(runes) == 0 {
+		e.buf.WriteByte(TagNil)
+		return nil
+	}
+
+	latin1 := len(runes) <= math.MaxUint16
+	for _, r := range runes {
+		if r > 255 {
+			latin1 = false
+			break
+		}
+	}
+	if latin1 {
+		e.buf.WriteByte(TagString)
+		if err := binary.Write(e.buf, binary.BigEndian, uint16(len(runes))); err != nil {
+			return err
+		}
+		for _, r := range runes {
+			e.buf.WriteByte(byte(r))
+		}
+		return nil
+	}
+
+	e.buf.WriteByte(TagList)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(runes))); err != nil {
+		return err
+	}
+	for _, r := range runes {
+		if err := e.encodeInt(int64(r)); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte(TagNil)
+	return nil
+}
+
+func (e *encodeState) encodeBinary(data []byte) error {
+	e.buf.WriteByte(TagBinary)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	e.buf.Write(data)
+	return nil
+}
+
+// encodeBitString uses BIT_BINARY_EXT, unless the bitstring is a plain binary.
+func (e *encodeState) encodeBitString(b BitString) error {
+	if len(b.Bytes) == 0 || b.Bits == 8 {
+		return e.encodeBinary(b.Bytes)
+	}
+	if b.Bits == 0 || b.Bits > 8 {
+		return fmt.Errorf("invalid number of bits in bitstring last byte: %d", b.Bits)
+	}
+
+	e.buf.WriteByte(TagBitBinary)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(b.Bytes))); err != nil {
+		return err
+	}
+	e.buf.WriteByte(b.Bits)
+	e.buf.Write(b.Bytes)
+	return nil
+}
+
+// encodeInt uses the smallest Erlang integer representation able to hold the value.
+func (e *encodeState) encodeInt(i int64) error {
+	switch {
+	case i >= 0 && i <= 255:
+		e.buf.WriteByte(TagSmallInteger)
+		e.buf.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		e.buf.WriteByte(TagInteger)
+		if err := binary.Write(e.buf, binary.BigEndian, int32(i)); err != nil {
+			return err
+		}
+	default:
+		return e.encodeBigInt(big.NewInt(i))
+	}
+	return nil
+}
+
+func (e *encodeState) encodeUint(u uint64) error {
+	if u <= math.MaxInt32 {
+		return e.encodeInt(int64(u))
+	}
+	return e.encodeBigInt(new(big.Int).SetUint64(u))
+}
+
+// encodeBigInt encodes an arbitrary-precision integer. Values fitting in 32 bits
+// still use the integer representations, as Erlang does.
+// Big integers are encoded as a sign byte followed by the magnitude in little-endian order.
+func (e *encodeState) encodeBigInt(i *big.Int) error {
+	if i.IsInt64() {
+		if v := i.Int64(); v >= math.MinInt32 && v <= math.MaxInt32 {
+			return e.encodeInt(v)
+		}
+	}
+
+	// Magnitude is returned in big-endian order
+	digits := i.Bytes()
+	n := len(digits)
+	if n <= 255 {
+		e.buf.WriteByte(TagSmallBig)
+		e.buf.WriteByte(byte(n))
 	} else {
-		buf.WriteByte(TagInteger)
-		if err := binary.Write(buf, binary.BigEndian, i); err != nil {
+		e.buf.WriteByte(TagLargeBig)
+		if err := binary.Write(e.buf, binary.BigEndian, uint32(n)); err != nil {
 			return err
 		}
 	}
+
+	if i.Sign() < 0 {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+	for j := n - 1; j >= 0; j-- {
+		e.buf.WriteByte(digits[j])
+	}
 	return nil
 }
 
-func encodeTuple(buf *bytes.Buffer, tuple Tuple) error {
+// encodeFloat encodes a float using NEW_FLOAT_EXT, an 8 bytes IEEE 754 big-endian float.
+// Erlang floats cannot be NaN or infinite.
+func (e *encodeState) encodeFloat(f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("cannot encode %v: Erlang does not support NaN or infinite floats", f)
+	}
+	e.buf.WriteByte(TagNewFloat)
+	return binary.Write(e.buf, binary.BigEndian, math.Float64bits(f))
+}
+
+func (e *encodeState) encodeTuple(tuple Tuple) error {
 	// Tuple header
 	size := len(tuple.Elems)
 	if size <= 255 {
 		// Encode small tuple
-		buf.WriteByte(TagSmallTuple)
-		buf.WriteByte(byte(size))
+		e.buf.WriteByte(TagSmallTuple)
+		e.buf.WriteByte(byte(size))
 	} else {
 		// Encode large tuple
-		buf.WriteByte(TagLargeTuple)
-		if err := binary.Write(buf, binary.BigEndian, int32(size)); err != nil {
+		e.buf.WriteByte(TagLargeTuple)
+		if err := binary.Write(e.buf, binary.BigEndian, int32(size)); err != nil {
 			return err
 		}
 	}
 
 	// Tuple content
 	for _, elem := range tuple.Elems {
-		if err := encodePayloadTo(elem, buf); err != nil {
+		if err := e.encodePayloadTo(elem); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func encodeList(buf *bytes.Buffer, list []interface{}) error {
+func (e *encodeState) encodeList(list []interface{}) error {
 	var err error
-	// TODO: Special case for empty list: v.Len() ? Should not be needed
+	// Empty list is encoded as nil
+	if len(list) == 0 {
+		e.buf.WriteByte(TagNil)
+		return nil
+	}
+	if e.opts.Deterministic {
+		return e.encodeDeterministicList(list)
+	}
 
 	// List header
-	buf.WriteByte(TagList)
-	if err := binary.Write(buf, binary.BigEndian, int32(len(list))); err != nil {
+	e.buf.WriteByte(TagList)
+	if err := binary.Write(e.buf, binary.BigEndian, int32(len(list))); err != nil {
 		return err
 	}
 
 	// List content
 	for _, elem := range list {
-		if err := encodePayloadTo(elem, buf); err != nil {
+		if err := e.encodePayloadTo(elem); err != nil {
 			return err
 		}
 	}
 	// nil terminates the list:
-	buf.Write([]byte{TagNil})
+	e.buf.Write([]byte{TagNil})
 	return err
 }
 
+// encodeDeterministicList encodes a list as Erlang does: lists of small integers use
+// STRING_EXT, like strings.
+func (e *encodeState) encodeDeterministicList(list []interface{}) error {
+	var elems bytes.Buffer
+	sub := &encodeState{buf: &elems, opts: e.opts}
+	chars := make([]byte, 0, len(list))
+	for _, elem := range list {
+		start := elems.Len()
+		if err := sub.encodePayloadTo(elem); err != nil {
+			return err
+		}
+		if p := elems.Bytes()[start:]; len(p) == 2 && p[0] == TagSmallInteger {
+			chars = append(chars, p[1])
+		}
+	}
+
+	if len(chars) == len(list) && len(list) <= math.MaxUint16 {
+		e.buf.WriteByte(TagString)
+		if err := binary.Write(e.buf, binary.BigEndian, uint16(len(chars))); err != nil {
+			return err
+		}
+		e.buf.Write(chars)
+		return nil
+	}
+
+	e.buf.WriteByte(TagList)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(list))); err != nil {
+		return err
+	}
+	e.buf.Write(elems.Bytes())
+	e.buf.WriteByte(TagNil)
+	return nil
+}
+
+// encodePid uses NEW_PID_EXT, the representation used by Erlang since OTP 23.
+func (e *encodeState) encodePid(pid Pid) error {
+	e.buf.WriteByte(TagNewPid)
+	if err := e.encodeAtom(pid.Node); err != nil {
+		return err
+	}
+	return binary.Write(e.buf, binary.BigEndian, []uint32{pid.ID, pid.Serial, pid.Creation})
+}
+
+// encodePort uses NEW_PORT_EXT, unless the port ID does not fit in 32 bits.
+func (e *encodeState) encodePort(port Port) error {
+	if port.ID > math.MaxUint32 {
+		e.buf.WriteByte(TagV4Port)
+		if err := e.encodeAtom(port.Node); err != nil {
+			return err
+		}
+		if err := binary.Write(e.buf, binary.BigEndian, port.ID); err != nil {
+			return err
+		}
+	} else {
+		e.buf.WriteByte(TagNewPort)
+		if err := e.encodeAtom(port.Node); err != nil {
+			return err
+		}
+		if err := binary.Write(e.buf, binary.BigEndian, uint32(port.ID)); err != nil {
+			return err
+		}
+	}
+	return binary.Write(e.buf, binary.BigEndian, port.Creation)
+}
+
+// encodeRef uses NEWER_REFERENCE_EXT, the representation used by Erlang since OTP 23.
+func (e *encodeState) encodeRef(ref Ref) error {
+	if len(ref.ID) > math.MaxUint16 {
+		return fmt.Errorf("cannot encode reference with %d ID words", len(ref.ID))
+	}
+	e.buf.WriteByte(TagNewerReference)
+	if err := binary.Write(e.buf, binary.BigEndian, uint16(len(ref.ID))); err != nil {
+		return err
+	}
+	if err := e.encodeAtom(ref.Node); err != nil {
+		return err
+	}
+	if err := binary.Write(e.buf, binary.BigEndian, ref.Creation); err != nil {
+		return err
+	}
+	return binary.Write(e.buf, binary.BigEndian, ref.ID)
+}
+
+func (e *encodeState) encodeExport(export Export) error {
+	e.buf.WriteByte(TagExport)
+	if err := e.encodeAtom(export.Module); err != nil {
+		return err
+	}
+	if err := e.encodeAtom(export.Function); err != nil {
+		return err
+	}
+	return e.encodeInt(int64(export.Arity))
+}
+
+// encodeFun writes back the fun exactly as it was decoded. Funs cannot be
+// created from Go.
+func (e *encodeState) encodeFun(f Fun) error {
+	if len(f.data) == 0 {
+		return fmt.Errorf("cannot encode fun %s: funs can only be encoded after being decoded", f)
+	}
+	e.buf.Write(f.data)
+	return nil
+}
+
+// encodeImproperList encodes the elements of the list, followed by its tail instead of nil.
+func (e *encodeState) encodeImproperList(list ImproperList) error {
+	if len(list.Elems) == 0 {
+		return fmt.Errorf("cannot encode improper list without elements")
+	}
+
+	// List header
+	e.buf.WriteByte(TagList)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(list.Elems))); err != nil {
+		return err
+	}
+
+	// List content
+	for _, elem := range list.Elems {
+		if err := e.encodePayloadTo(elem); err != nil {
+			return err
+		}
+	}
+	return e.encodePayloadTo(list.Tail)
+}
+
+// encodeMap encodes a Go map as an Erlang map.
+// Go does not guarantee map iteration order, so the order of the keys in the
+// encoded map is not stable, unless the encoding is deterministic.
+func (e *encodeState) encodeMap(m reflect.Value) error {
+	if e.opts.Deterministic {
+		entries := make(Map, 0, m.Len())
+		iter := m.MapRange()
+		for iter.Next() {
+			entries = append(entries, MapEntry{Key: iter.Key().Interface(), Value: iter.Value().Interface()})
+		}
+		return e.encodeMapEntries(entries)
+	}
+
+	// Map header
+	e.buf.WriteByte(TagMap)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(m.Len())); err != nil {
+		return err
+	}
+
+	// Map content
+	iter := m.MapRange()
+	for iter.Next() {
+		if err := e.encodePayloadTo(iter.Key().Interface()); err != nil {
+			return err
+		}
+		if err := e.encodePayloadTo(iter.Value().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMapEntries encodes a generic Map, keeping the order of the entries, unless
+// the encoding is deterministic.
+func (e *encodeState) encodeMapEntries(m Map) error {
+	if e.opts.Deterministic {
+		return e.encodeSortedMap(m)
+	}
+
+	// Map header
+	e.buf.WriteByte(TagMap)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(m))); err != nil {
+		return err
+	}
+
+	// Map content
+	for _, entry := range m {
+		if err := e.encodePayloadTo(entry.Key); err != nil {
+			return err
+		}
+		if err := e.encodePayloadTo(entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeSortedMap encodes a map with its keys sorted in Erlang term order.
+// Entries are encoded first, and their keys decoded back to generic terms to be compared.
+func (e *encodeState) encodeSortedMap(m Map) error {
+	type encodedEntry struct {
+		key  interface{}
+		data []byte
+	}
+	entries := make([]encodedEntry, len(m))
+	for i, entry := range m {
+		var buf bytes.Buffer
+		sub := &encodeState{buf: &buf, opts: e.opts}
+		if err := sub.encodePayloadTo(entry.Key); err != nil {
+			return err
+		}
+		d := &decodeState{data: buf.Bytes(), opts: DecodeOptions{AliasBytes: true, Limits: unlimited}}
+		key, err := d.decodeTerm()
+		if err != nil {
+			return err
+		}
+		if err := sub.encodePayloadTo(entry.Value); err != nil {
+			return err
+		}
+		entries[i] = encodedEntry{key: key, data: buf.Bytes()}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compareTerms(entries[i].key, entries[j].key) < 0
+	})
+
+	e.buf.WriteByte(TagMap)
+	if err := binary.Write(e.buf, binary.BigEndian, uint32(len(entries))); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		e.buf.Write(entry.data)
+	}
+	return nil
+}
+
+// encodeStruct encodes a struct as a tuple, a record or a map, depending on its
+// erlang tags.
+func (e *encodeState) encodeStruct(v reflect.Value) error {
+	info := getStructInfo(v.Type())
+	if isTaggedStruct(v.Type()) {
+		return e.encodeTaggedStruct(v, info)
+	}
+	if info.asMap {
+		return e.encodeStructMap(v, info)
+	}
+
+	elems := make([]interface{}, 0, len(info.fields)+1)
+	if info.record != "" {
+		elems = append(elems, A(info.record))
+	}
+	for _, f := range info.fields {
+		elem, err := fieldTerm(v, f)
+		if err != nil {
+			return err
+		}
+		elems = append(elems, elem)
+	}
+	return e.encodeTuple(Tuple{elems})
+}
+
+// encodeTaggedStruct encodes the tag as an atom when there is no field for it,
+// or as a tuple containing the tag and the matching fields otherwise.
+func (e *encodeState) encodeTaggedStruct(v reflect.Value, info structInfo) error {
+	tag := v.Field(0).String()
+	if tag == "" {
+		return fmt.Errorf("cannot encode %s with an empty tag", v.Type())
+	}
+
+	fields := tagFields(info, tag)
+	if len(fields) == 0 {
+		return e.encodeAtom(tag)
+	}
+
+	elems := make([]interface{}, 0, len(fields)+1)
+	elems = append(elems, A(tag))
+	for _, f := range fields {
+		elem, err := fieldTerm(v, f)
+		if err != nil {
+			return err
+		}
+		elems = append(elems, elem)
+	}
+	return e.encodeTuple(Tuple{elems})
+}
+
+func (e *encodeState) encodeStructMap(v reflect.Value, info structInfo) error {
+	var m Map
+	for _, f := range info.fields {
+		if f.omitEmpty && isEmptyValue(v.Field(f.index)) {
+			continue
+		}
+		value, err := fieldTerm(v, f)
+		if err != nil {
+			return err
+		}
+		m = append(m, MapEntry{Key: A(f.name), Value: value})
+	}
+	return e.encodeMapEntries(m)
+}
+
+// fieldTerm returns the term to encode for a struct field.
+func fieldTerm(v reflect.Value, f fieldInfo) (interface{}, error) {
+	field := v.Field(f.index)
+	if f.time != "" {
+		switch {
+		case field.Type() == reflect.PtrTo(timeType) && field.IsNil():
+			return nil, nil
+		case field.Type() == reflect.PtrTo(timeType):
+			field = field.Elem()
+		case field.Type() != timeType:
+			return nil, fmt.Errorf("%s option cannot be used on field %s of type %s",
+				f.time, v.Type().Field(f.index).Name, field.Type())
+		}
+		return timeTerm(field.Interface().(time.Time), f.time)
+	}
+	if f.atom {
+		if field.Kind() != reflect.String {
+			return nil, fmt.Errorf("atom option cannot be used on field %s of type %s",
+				v.Type().Field(f.index).Name, field.Type())
+		}
+		return A(field.String()), nil
+	}
+	return field.Interface(), nil
+}
+
 // ============================================================================
 // Helpers
 
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
+
 func makeGenericSlice(slice interface{}) ([]interface{}, error) {
 	s := reflect.ValueOf(slice)
 	switch s.Kind() {
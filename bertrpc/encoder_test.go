@@ -2,6 +2,10 @@ package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
 
 import (
 	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
 
 	"gosrc.io/erlang/bertrpc"
@@ -20,7 +24,7 @@ func TestEncodeSmallAtom(t *testing.T) {
 	}
 }
 
-// We encode strings to binary, but we can force them to charlist (see TestEncodeCharList)
+// We encode strings to binary, but we can force them to charlist (see TestEncodeStringMode)
 func TestEncodeString(t *testing.T) {
 	data, err := bertrpc.Encode("string")
 	if err != nil {
@@ -83,6 +87,111 @@ func TestEncodeMiscInt(t *testing.T) {
 	}
 }
 
+func TestEncodeBigInt(t *testing.T) {
+	large := new(big.Int).Lsh(big.NewInt(1), 8*256)
+	var tests = []struct {
+		n        interface{}
+		expected []byte
+	}{
+		{int64(2147483648), []byte{131, bertrpc.TagSmallBig, 4, 0, 0, 0, 0, 128}},
+		{int64(-2147483649), []byte{131, bertrpc.TagSmallBig, 4, 1, 1, 0, 0, 128}},
+		{int64(1565000000000000), []byte{131, bertrpc.TagSmallBig, 7, 0, 0, 208, 18, 245, 91, 143, 5}},
+		{uint32(4294967295), []byte{131, bertrpc.TagSmallBig, 4, 0, 255, 255, 255, 255}},
+		{uint64(18446744073709551615), []byte{131, bertrpc.TagSmallBig, 8, 0, 255, 255, 255, 255, 255, 255, 255, 255}},
+		{new(big.Int).Lsh(big.NewInt(1), 64), []byte{131, bertrpc.TagSmallBig, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		// Small values keep the integer representation
+		{big.NewInt(42), []byte{131, bertrpc.TagSmallInteger, 42}},
+		{big.NewInt(-1), []byte{131, bertrpc.TagInteger, 255, 255, 255, 255}},
+		{large, append(append([]byte{131, bertrpc.TagLargeBig, 0, 0, 1, 1, 0}, make([]byte, 256)...), 1)},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.n)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeBigInt %d: expected %v, actual %v", tt.n, tt.expected, data)
+		}
+	}
+}
+
+func TestEncodeFloat(t *testing.T) {
+	var tests = []struct {
+		f        interface{}
+		expected []byte
+	}{
+		{3.14, []byte{131, bertrpc.TagNewFloat, 64, 9, 30, 184, 81, 235, 133, 31}},
+		{-0.5, []byte{131, bertrpc.TagNewFloat, 191, 224, 0, 0, 0, 0, 0, 0}},
+		{float32(1.5), []byte{131, bertrpc.TagNewFloat, 63, 248, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.f)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeFloat %v: expected %v, actual %v", tt.f, tt.expected, data)
+		}
+	}
+}
+
+func TestEncodeInvalidFloat(t *testing.T) {
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := bertrpc.Encode(f); err == nil {
+			t.Errorf("encoding %v should fail", f)
+		}
+	}
+}
+
+func TestEncodeIdentifiers(t *testing.T) {
+	node := []byte{119, 13, 110, 111, 110, 111, 100, 101, 64, 110, 111, 104, 111, 115, 116} // nonode@nohost
+	var tests = []struct {
+		name     string
+		term     interface{}
+		expected []byte
+	}{
+		{"pid", bertrpc.Pid{Node: "nonode@nohost", ID: 123, Serial: 1, Creation: 2},
+			join([]byte{131, bertrpc.TagNewPid}, node, []byte{0, 0, 0, 123, 0, 0, 0, 1, 0, 0, 0, 2})},
+		{"port", bertrpc.Port{Node: "nonode@nohost", ID: 42, Creation: 2},
+			join([]byte{131, bertrpc.TagNewPort}, node, []byte{0, 0, 0, 42, 0, 0, 0, 2})},
+		{"v4 port", bertrpc.Port{Node: "nonode@nohost", ID: 1 << 32, Creation: 2},
+			join([]byte{131, bertrpc.TagV4Port}, node, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2})},
+		{"ref", bertrpc.Ref{Node: "nonode@nohost", Creation: 2, ID: []uint32{1, 2, 3}},
+			join([]byte{131, bertrpc.TagNewerReference, 0, 3}, node, []byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeIdentifiers %s: expected %v, actual %v", tt.name, tt.expected, data)
+		}
+	}
+}
+
+func TestEncodeExport(t *testing.T) {
+	data, err := bertrpc.Encode(bertrpc.Export{Module: "lists", Function: "reverse", Arity: 1})
+	if err != nil {
+		t.Error(err)
+	}
+	// fun lists:reverse/1
+	expected := []byte{131, 113, 119, 5, 108, 105, 115, 116, 115, 119, 7, 114, 101, 118, 101, 114, 115, 101, 97, 1}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeExport: expected %v, actual %v", expected, data)
+	}
+}
+
+// Funs cannot be created from Go
+func TestEncodeFun(t *testing.T) {
+	if _, err := bertrpc.Encode(bertrpc.Fun{Module: "erl_eval"}); err == nil {
+		t.Errorf("encoding a fun not decoded from Erlang should fail")
+	}
+}
+
 func TestEncodeTuple(t *testing.T) {
 	tuple := bertrpc.T(bertrpc.A("atom"), "string", 42)
 
@@ -137,6 +246,72 @@ func TestEncodeList(t *testing.T) {
 	}
 }
 
+func TestEncodeEmptyList(t *testing.T) {
+	data, err := bertrpc.Encode(bertrpc.List{})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []byte{131, 106}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeEmptyList: expected %v, actual %v", expected, data)
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	data, err := bertrpc.Encode([]byte{1, 2, 3})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []byte{131, 109, 0, 0, 0, 3, 1, 2, 3}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeBinary: expected %v, actual %v", expected, data)
+	}
+}
+
+func TestEncodeBitString(t *testing.T) {
+	var tests = []struct {
+		b        bertrpc.BitString
+		expected []byte
+	}{
+		// <<1, 2:3>>
+		{bertrpc.BitString{Bytes: []byte{1, 64}, Bits: 3}, []byte{131, 77, 0, 0, 0, 2, 3, 1, 64}},
+		// Full bytes are sent as binary: <<1, 2>>
+		{bertrpc.BitString{Bytes: []byte{1, 2}, Bits: 8}, []byte{131, 109, 0, 0, 0, 2, 1, 2}},
+		{bertrpc.BitString{}, []byte{131, 109, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.b)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeBitString %v: expected %v, actual %v", tt.b, tt.expected, data)
+		}
+	}
+
+	if _, err := bertrpc.Encode(bertrpc.BitString{Bytes: []byte{1}, Bits: 9}); err == nil {
+		t.Errorf("encoding a bitstring with more than 8 bits in last byte should fail")
+	}
+}
+
+func TestEncodeImproperList(t *testing.T) {
+	list := bertrpc.ImproperList{Elems: []interface{}{bertrpc.A("a")}, Tail: bertrpc.A("b")}
+	data, err := bertrpc.Encode(list)
+	if err != nil {
+		t.Error(err)
+	}
+	// [a | b]
+	expected := []byte{131, 108, 0, 0, 0, 1, 119, 1, 97, 119, 1, 98}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeImproperList: expected %v, actual %v", expected, data)
+	}
+
+	if _, err := bertrpc.Encode(bertrpc.ImproperList{Tail: bertrpc.A("b")}); err == nil {
+		t.Errorf("encoding an improper list without elements should fail")
+	}
+}
+
 func TestEncodeIntSlice(t *testing.T) {
 	list := []int{1, 2, 3}
 
@@ -167,8 +342,515 @@ func TestEncodeTupleList(t *testing.T) {
 	}
 }
 
+func TestEncodeMap(t *testing.T) {
+	m := map[string]int{"a": 1}
+	data, err := bertrpc.Encode(m)
+	if err != nil {
+		t.Error(err)
+	}
+	// #{<<"a">> => 1}
+	expected := []byte{131, 116, 0, 0, 0, 1, 109, 0, 0, 0, 1, 97, 97, 1}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeMap: expected %v, actual %v", expected, data)
+	}
+}
+
+// Generic Map keeps the order of its entries
+func TestEncodeGenericMap(t *testing.T) {
+	m := bertrpc.Map{
+		{Key: bertrpc.A("a"), Value: 1},
+		{Key: bertrpc.T(1, 2), Value: "b"},
+	}
+	data, err := bertrpc.Encode(m)
+	if err != nil {
+		t.Error(err)
+	}
+	// #{a => 1, {1, 2} => <<"b">>}
+	expected := []byte{131, 116, 0, 0, 0, 2, 119, 1, 97, 97, 1, 104, 2, 97, 1, 97, 2, 109, 0, 0, 0, 1, 98}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeGenericMap: expected %v, actual %v", expected, data)
+	}
+}
+
+// Go map iteration order is random, so we check larger maps by decoding them back.
+func TestEncodeMapRoundTrip(t *testing.T) {
+	m := map[string]int{"one": 1, "two": 2, "three": 3, "thousand": 1000}
+	data, err := bertrpc.Encode(m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var decoded map[string]int
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &decoded); err != nil {
+		t.Errorf("cannot decode encoded map: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("EncodeMapRoundTrip: expected %v, actual %v", m, decoded)
+	}
+}
+
+func TestEncodeCompressed(t *testing.T) {
+	term := strings.Repeat("roster item ", 100)
+	opts := bertrpc.EncodeOptions{CompressionLevel: 6, CompressionThreshold: 64}
+
+	data, err := bertrpc.EncodeWithOptions(term, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// Header: compressed tag, followed by uncompressed size: 5 bytes binary header + 1200 bytes
+	expected := []byte{131, 80, 0, 0, 4, 181}
+	if !bytes.Equal(data[:6], expected) {
+		t.Errorf("EncodeCompressed: expected header %v, actual %v", expected, data[:6])
+	}
+	if len(data) > 100 {
+		t.Errorf("EncodeCompressed: data was not compressed: %d bytes", len(data))
+	}
+
+	var decoded string
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &decoded); err != nil {
+		t.Errorf("cannot decode compressed term: %s", err)
+		return
+	}
+	if decoded != term {
+		t.Errorf("EncodeCompressed: incorrect decoded value: %s", decoded)
+	}
+}
+
+func TestEncodeCompressedThreshold(t *testing.T) {
+	opts := bertrpc.EncodeOptions{CompressionLevel: 9, CompressionThreshold: 64}
+	tests := []struct {
+		name string
+		term interface{}
+	}{
+		{"small term", "aaaaaaaaaaaaaaaa"},
+		// Compression would make the term larger
+		{"incompressible term", []byte{0x5e, 0xb3, 0x1d, 0x71, 0xc0, 0x27, 0x9a, 0x48, 0xf2, 0x86, 0x0d, 0x3b, 0xe4, 0x59,
+			0xa7, 0x12, 0x6c, 0xd8, 0x95, 0x2f, 0x40, 0xbb, 0x73, 0x0e, 0xc9, 0x64, 0x31, 0xfa, 0x88, 0x1b, 0x57, 0xe6,
+			0x9d, 0x02, 0x4a, 0xb7, 0x6f, 0xd1, 0x38, 0x85, 0x23, 0xcc, 0x79, 0x10, 0xae, 0x54, 0xe9, 0x36, 0x8b, 0xf7,
+			0x61, 0x0a, 0xbd, 0x42, 0x97, 0xc4, 0x2c, 0x7e, 0x15, 0xd3, 0x68, 0xab, 0x06, 0x91}},
+	}
+
+	for _, tt := range tests {
+		compressed, err := bertrpc.EncodeWithOptions(tt.term, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		plain, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(compressed, plain) {
+			t.Errorf("EncodeCompressedThreshold %s: term should not be compressed: %v", tt.name, compressed)
+		}
+	}
+
+	if _, err := bertrpc.EncodeWithOptions(1, bertrpc.EncodeOptions{CompressionLevel: 10}); err == nil {
+		t.Errorf("encoding with invalid compression level should fail")
+	}
+}
+
+func TestEncodeStruct(t *testing.T) {
+	type user struct {
+		_      struct{} `erlang:"record=user"`
+		Name   string
+		Status string `erlang:",atom"`
+		Age    int
+		Cache  string `erlang:"-"`
+		secret string
+	}
+	type point struct {
+		X, Y int
+	}
+	type profile struct {
+		_     struct{} `erlang:"map"`
+		Nick  string   `erlang:"nick"`
+		Email string   `erlang:"email,omitempty"`
+		Age   int      `erlang:"age,omitempty"`
+	}
+
+	var tests = []struct {
+		name     string
+		term     interface{}
+		expected []byte
+	}{
+		// {1, 2}
+		{"tuple", point{1, 2}, []byte{131, 104, 2, 97, 1, 97, 2}},
+		// {user, <<"john">>, online, 42}
+		{"record", user{Name: "john", Status: "online", Age: 42, Cache: "x", secret: "y"},
+			[]byte{131, 104, 4, 119, 4, 117, 115, 101, 114, 109, 0, 0, 0, 4, 106, 111, 104, 110,
+				119, 6, 111, 110, 108, 105, 110, 101, 97, 42}},
+		// #{nick => <<"jd">>, age => 42}
+		{"map", profile{Nick: "jd", Age: 42},
+			[]byte{131, 116, 0, 0, 0, 2, 119, 4, 110, 105, 99, 107, 109, 0, 0, 0, 2, 106, 100, 119, 3, 97, 103, 101, 97, 42}},
+		// Nested structs: [{1, 2}]
+		{"nested", []point{{1, 2}}, []byte{131, 108, 0, 0, 0, 1, 104, 2, 97, 1, 97, 2, 106}},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeStruct %s: expected %v, actual %v", tt.name, tt.expected, data)
+		}
+	}
+}
+
+func TestEncodeInvalidAtomField(t *testing.T) {
+	type invalid struct {
+		Count int `erlang:",atom"`
+	}
+	if _, err := bertrpc.Encode(invalid{1}); err == nil {
+		t.Errorf("encoding a non string field as atom should fail")
+	}
+}
+
+type (
+	enabled bool
+	status  string
+	level   int
+	flags   uint8
+	score   float32
+)
+
+func TestEncodeNamedTypes(t *testing.T) {
+	type event struct {
+		Active enabled
+		Status status `erlang:",atom"`
+		Origin status
+		Level  level
+		Flags  flags
+		Score  score
+		Pos    [2]int
+	}
+	in := event{Active: true, Status: "up", Origin: "probe", Level: -3, Flags: 5, Score: 0.5, Pos: [2]int{1, 2}}
+	data, err := bertrpc.Encode(in)
+	if err != nil {
+		t.Errorf("cannot encode struct with named types: %s", err)
+		return
+	}
+	expected, err := bertrpc.Encode(bertrpc.T(true, bertrpc.A("up"), "probe", -3, 5, 0.5, bertrpc.List{1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("incorrect encoding: %v (!= %v)", data, expected)
+	}
+
+	var out event
+	if err := bertrpc.Unmarshal(data, &out); err != nil {
+		t.Errorf("cannot decode struct with named types: %s", err)
+		return
+	}
+	if out != in {
+		t.Errorf("incorrect round trip: %#v (!= %#v)", out, in)
+	}
+}
+
+type reply struct {
+	Tag    string `erlang:"tag"`
+	Reason string `erlang:"tag:error,atom"`
+	Name   string `erlang:"tag:user"`
+	Age    int    `erlang:"tag:user"`
+}
+
+func TestEncodeTaggedStruct(t *testing.T) {
+	var tests = []struct {
+		name     string
+		term     reply
+		expected []byte
+	}{
+		// ok
+		{"atom", reply{Tag: "ok"}, []byte{131, 119, 2, 111, 107}},
+		// {error, not_found}
+		{"tuple", reply{Tag: "error", Reason: "not_found"},
+			[]byte{131, 104, 2, 119, 5, 101, 114, 114, 111, 114, 119, 9, 110, 111, 116, 95, 102, 111, 117, 110, 100}},
+		// {user, <<"john">>, 42}
+		{"several fields", reply{Tag: "user", Name: "john", Age: 42},
+			[]byte{131, 104, 3, 119, 4, 117, 115, 101, 114, 109, 0, 0, 0, 4, 106, 111, 104, 110, 97, 42}},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeTaggedStruct %s: expected %v, actual %v", tt.name, tt.expected, data)
+		}
+
+		// Tagged structs can be decoded back
+		var decoded reply
+		if err := bertrpc.Decode(bytes.NewBuffer(data), &decoded); err != nil {
+			t.Errorf("EncodeTaggedStruct %s: cannot decode: %s", tt.name, err)
+		}
+		if decoded != tt.term {
+			t.Errorf("EncodeTaggedStruct %s: expected %#v, decoded %#v", tt.name, tt.term, decoded)
+		}
+	}
+
+	if _, err := bertrpc.Encode(reply{}); err == nil {
+		t.Errorf("encoding a tagged struct without tag should fail")
+	}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
 func BenchmarkBufferString(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, _ = bertrpc.Encode("test")
 	}
 }
+
+func TestEncodeRawTerm(t *testing.T) {
+	// Legacy atom 'Y', that Encode would not produce
+	raw := bertrpc.RawTerm{131, 100, 0, 1, 89}
+
+	data, err := bertrpc.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, raw) {
+		t.Errorf("EncodeRawTerm: expected %v, actual %v", raw, data)
+	}
+
+	data, err = bertrpc.Encode(bertrpc.T(bertrpc.A("ok"), bertrpc.L(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{131, 104, 2, 119, 2, 111, 107, 108, 0, 0, 0, 1, 100, 0, 1, 89, 106}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeRawTerm: expected %v, actual %v", expected, data)
+	}
+
+	// Compressed raw terms are inflated
+	compressed, err := bertrpc.EncodeWithOptions(make([]int, 100), bertrpc.EncodeOptions{CompressionLevel: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = bertrpc.Encode(bertrpc.T(bertrpc.RawTerm(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct{ List []int }
+	if err := bertrpc.Unmarshal(data, &res); err != nil || len(res.List) != 100 {
+		t.Errorf("incorrect compressed raw term encoding: %v", err)
+	}
+}
+
+func TestEncodeInvalidRawTerm(t *testing.T) {
+	for _, raw := range []bertrpc.RawTerm{
+		nil,
+		{131},
+		{97, 1},                    // No version tag
+		{131, 97, 1, 97},           // Trailing data
+		{131, 109, 0, 0, 0, 4, 97}, // Truncated binary
+	} {
+		if _, err := bertrpc.Encode(raw); err == nil {
+			t.Errorf("encoding invalid raw term %v should fail", raw)
+		}
+	}
+}
+
+// Expected bytes are the output of Erlang term_to_binary(Term, [deterministic]).
+func TestEncodeDeterministic(t *testing.T) {
+	var tests = []struct {
+		erlang   string
+		term     interface{}
+		expected []byte
+	}{
+		{"255", 255, []byte{131, 97, 255}},
+		{"256", 256, []byte{131, 98, 0, 0, 1, 0}},
+		{"-1", -1, []byte{131, 98, 255, 255, 255, 255}},
+		{"2147483648", int64(2147483648), []byte{131, 110, 4, 0, 0, 0, 0, 128}},
+		{"1.5", 1.5, []byte{131, 70, 63, 248, 0, 0, 0, 0, 0, 0}},
+		{"'héllo'", bertrpc.A("héllo"), []byte{131, 119, 6, 104, 195, 169, 108, 108, 111}},
+		{"[1, 2, 3]", []int{1, 2, 3}, []byte{131, 107, 0, 3, 1, 2, 3}},
+		{"[1, 256]", []int{1, 256}, []byte{131, 108, 0, 0, 0, 2, 97, 1, 98, 0, 0, 1, 0, 106}},
+		{"[a, 1]", bertrpc.List{bertrpc.A("a"), 1}, []byte{131, 108, 0, 0, 0, 2, 119, 1, 97, 97, 1, 106}},
+		{
+			"#{a => 2, b => 1}",
+			map[bertrpc.String]int{bertrpc.A("b"): 1, bertrpc.A("a"): 2},
+			[]byte{131, 116, 0, 0, 0, 2, 119, 1, 97, 97, 2, 119, 1, 98, 97, 1},
+		},
+		{
+			`#{<<"a">> => 2, <<"ab">> => 3, <<"b">> => 1}`,
+			map[string]int{"b": 1, "a": 2, "ab": 3},
+			[]byte{131, 116, 0, 0, 0, 3,
+				109, 0, 0, 0, 1, 97, 97, 2,
+				109, 0, 0, 0, 2, 97, 98, 97, 3,
+				109, 0, 0, 0, 1, 98, 97, 1},
+		},
+		{
+			"#{-1 => b, 10 => a, 100000000000 => c}",
+			bertrpc.Map{
+				{Key: 10, Value: bertrpc.A("a")},
+				{Key: int64(100000000000), Value: bertrpc.A("c")},
+				{Key: -1, Value: bertrpc.A("b")},
+			},
+			[]byte{131, 116, 0, 0, 0, 3,
+				98, 255, 255, 255, 255, 119, 1, 98,
+				97, 10, 119, 1, 97,
+				110, 5, 0, 0, 232, 118, 72, 23, 119, 1, 99},
+		},
+		{
+			// Keys of different types
+			`#{2 => 5, 1.0 => 4, a => 6, {} => 3, #{} => 8, [] => 2, "ab" => 7, <<"x">> => 1}`,
+			bertrpc.Map{
+				{Key: []byte("x"), Value: 1},
+				{Key: bertrpc.List{}, Value: 2},
+				{Key: bertrpc.Tuple{}, Value: 3},
+				{Key: 1.0, Value: 4},
+				{Key: 2, Value: 5},
+				{Key: bertrpc.A("a"), Value: 6},
+				{Key: bertrpc.CharList{Value: "ab"}, Value: 7},
+				{Key: bertrpc.Map{}, Value: 8},
+			},
+			[]byte{131, 116, 0, 0, 0, 8,
+				97, 2, 97, 5,
+				70, 63, 240, 0, 0, 0, 0, 0, 0, 97, 4,
+				119, 1, 97, 97, 6,
+				104, 0, 97, 3,
+				116, 0, 0, 0, 0, 97, 8,
+				106, 97, 2,
+				107, 0, 2, 97, 98, 97, 7,
+				109, 0, 0, 0, 1, 120, 97, 1},
+		},
+		{
+			// Tuples are compared by size first
+			"#{{b} => 1, {a, a} => 2}",
+			bertrpc.Map{
+				{Key: bertrpc.T(bertrpc.A("a"), bertrpc.A("a")), Value: 2},
+				{Key: bertrpc.T(bertrpc.A("b")), Value: 1},
+			},
+			[]byte{131, 116, 0, 0, 0, 2,
+				104, 1, 119, 1, 98, 97, 1,
+				104, 2, 119, 1, 97, 119, 1, 97, 97, 2},
+		},
+		{
+			// Lists are compared element by element
+			"#{[1] => y, [1, 2] => x, [2] => z}",
+			bertrpc.Map{
+				{Key: []int{1, 2}, Value: bertrpc.A("x")},
+				{Key: []int{2}, Value: bertrpc.A("z")},
+				{Key: []int{1}, Value: bertrpc.A("y")},
+			},
+			[]byte{131, 116, 0, 0, 0, 3,
+				107, 0, 1, 1, 119, 1, 121,
+				107, 0, 2, 1, 2, 119, 1, 120,
+				107, 0, 1, 2, 119, 1, 122},
+		},
+		{
+			"#{z => #{a => 2, b => 1}}",
+			bertrpc.Map{{Key: bertrpc.A("z"), Value: bertrpc.Map{
+				{Key: bertrpc.A("b"), Value: 1},
+				{Key: bertrpc.A("a"), Value: 2},
+			}}},
+			[]byte{131, 116, 0, 0, 0, 1, 119, 1, 122,
+				116, 0, 0, 0, 2, 119, 1, 97, 97, 2, 119, 1, 98, 97, 1},
+		},
+		{
+			// Raw terms are encoded again: ATOM_EXT and LIST_EXT are not used by Erlang here
+			"{ok, [1, 2]}",
+			bertrpc.T(
+				bertrpc.RawTerm{131, 100, 0, 2, 111, 107},
+				bertrpc.RawTerm{131, 108, 0, 0, 0, 2, 97, 1, 97, 2, 106},
+			),
+			[]byte{131, 104, 2, 119, 2, 111, 107, 107, 0, 2, 1, 2},
+		},
+	}
+
+	opts := bertrpc.EncodeOptions{Deterministic: true}
+	for _, tt := range tests {
+		data, err := bertrpc.EncodeWithOptions(tt.term, opts)
+		if err != nil {
+			t.Errorf("cannot encode %s: %s", tt.erlang, err)
+			continue
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeDeterministic %s: expected %v, actual %v", tt.erlang, tt.expected, data)
+		}
+	}
+}
+
+// Large Go maps always have the same encoding.
+func TestEncodeDeterministicMap(t *testing.T) {
+	m := make(map[int]string)
+	for i := 0; i < 100; i++ {
+		m[i*37%101] = strings.Repeat("x", i)
+	}
+	opts := bertrpc.EncodeOptions{Deterministic: true}
+	expected, err := bertrpc.EncodeWithOptions(m, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		data, err := bertrpc.EncodeWithOptions(m, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("deterministic encoding of map changed: %v, then %v", expected, data)
+		}
+	}
+
+	var term interface{}
+	if err := bertrpc.Unmarshal(expected, &term); err != nil {
+		t.Fatal(err)
+	}
+	decoded := term.(bertrpc.Map)
+	for i := 1; i < len(decoded); i++ {
+		if decoded[i-1].Key.(int64) >= decoded[i].Key.(int64) {
+			t.Errorf("map keys are not sorted: %v", decoded)
+			break
+		}
+	}
+}
+
+type optionalFields struct {
+	Name  *string
+	Count *int
+	Admin bool
+}
+
+func TestEncodeBoolNilAndPointers(t *testing.T) {
+	name := "alice"
+	var tests = []struct {
+		term     interface{}
+		opts     bertrpc.EncodeOptions
+		expected interface{}
+	}{
+		{true, bertrpc.EncodeOptions{}, bertrpc.A("true")},
+		{false, bertrpc.EncodeOptions{}, bertrpc.A("false")},
+		{nil, bertrpc.EncodeOptions{}, bertrpc.A("undefined")},
+		{nil, bertrpc.EncodeOptions{NilAtom: "nil"}, bertrpc.A("nil")},
+		{(*int)(nil), bertrpc.EncodeOptions{}, bertrpc.A("undefined")},
+		{&name, bertrpc.EncodeOptions{}, "alice"},
+		{
+			optionalFields{Name: &name, Admin: true},
+			bertrpc.EncodeOptions{NilAtom: "nil"},
+			bertrpc.T("alice", bertrpc.A("nil"), bertrpc.A("true")),
+		},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.EncodeWithOptions(tt.term, tt.opts)
+		if err != nil {
+			t.Errorf("cannot encode %#v: %s", tt.term, err)
+			continue
+		}
+		expected, err := bertrpc.Encode(tt.expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("encoding %#v: expected %v, actual %v", tt.term, expected, data)
+		}
+	}
+}
@@ -1,30 +1,74 @@
 package bertrpc // import "gosrc.io/erlang/bertrpc"
 
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
 // Supported ETF types
 const (
+	TagNewFloat       = 70
+	TagBitBinary      = 77
+	TagCompressed     = 80
+	TagNewPid         = 88
+	TagNewPort        = 89
+	TagNewerReference = 90
 	TagSmallInteger   = 97
 	TagInteger        = 98
+	TagFloat          = 99
 	TagDeprecatedAtom = 100
+	TagReference      = 101
+	TagPort           = 102
+	TagPid            = 103
 	TagSmallTuple     = 104
 	TagLargeTuple     = 105
 	TagNil            = 106
 	TagString         = 107
 	TagList           = 108
 	TagBinary         = 109
+	TagSmallBig       = 110
+	TagLargeBig       = 111
+	TagNewFun         = 112
+	TagExport         = 113
+	TagNewReference   = 114
+	TagMap            = 116
 	TagAtomUTF8       = 118
 	TagSmallAtomUTF8  = 119
+	TagV4Port         = 120
 	TagETFVersion     = 131
 )
 
 // tagName convert a tag ID to its human readable tag name.
 func tagName(tag int) string {
 	switch tag {
+	case TagNewFloat:
+		return "NewFloat"
+	case TagBitBinary:
+		return "BitBinary"
+	case TagCompressed:
+		return "Compressed"
+	case TagNewPid:
+		return "NewPid"
+	case TagNewPort:
+		return "NewPort"
+	case TagNewerReference:
+		return "NewerReference"
 	case TagSmallInteger:
 		return "SmallInteger"
 	case TagInteger:
 		return "Integer"
+	case TagFloat:
+		return "Float"
 	case TagDeprecatedAtom:
 		return "DeprecatedAtom"
+	case TagReference:
+		return "Reference"
+	case TagPort:
+		return "Port"
+	case TagPid:
+		return "Pid"
 	case TagSmallTuple:
 		return "SmallTuple"
 	case TagLargeTuple:
@@ -37,14 +81,28 @@ func tagName(tag int) string {
 		return "List"
 	case TagBinary:
 		return "Binary"
+	case TagSmallBig:
+		return "SmallBig"
+	case TagLargeBig:
+		return "LargeBig"
+	case TagNewFun:
+		return "NewFun"
+	case TagExport:
+		return "Export"
+	case TagNewReference:
+		return "NewReference"
+	case TagMap:
+		return "Map"
 	case TagAtomUTF8:
 		return "AtomUTF8"
 	case TagSmallAtomUTF8:
 		return "SmallAtomUTF"
+	case TagV4Port:
+		return "V4Port"
 	case TagETFVersion:
 		return "VersionTag"
 	default:
-		return string(tag)
+		return strconv.Itoa(tag)
 	}
 }
 
@@ -75,6 +133,26 @@ func (str String) IsAtom() bool {
 	return str.ErlangType == StringTypeAtom
 }
 
+// ============================================================================
+// Bitstring
+
+// BitString is an Erlang bitstring, a binary whose length in bits is not
+// necessarily a multiple of 8.
+// Bits is the number of bits used in the last byte, from the most significant bit.
+// It is between 1 and 8, 8 meaning that the bitstring is a plain binary.
+type BitString struct {
+	Bytes []byte
+	Bits  uint8
+}
+
+// BitLen returns the length of the bitstring in bits.
+func (b BitString) BitLen() int {
+	if len(b.Bytes) == 0 {
+		return 0
+	}
+	return (len(b.Bytes)-1)*8 + int(b.Bits)
+}
+
 // ============================================================================
 // List / Collection types
 
@@ -82,8 +160,64 @@ type Tuple struct {
 	Elems []interface{}
 }
 
+// String returns the tuple in Erlang syntax.
+func (t Tuple) String() string {
+	return formatString(t)
+}
+
 type List []interface{}
 
+// String returns the list in Erlang syntax.
+func (l List) String() string {
+	return formatString(l)
+}
+
+// RawTerm is an encoded Erlang term, in External Term Format with its version tag.
+// Decoding to a RawTerm captures the exact encoding of a term without decoding it,
+// so that it can be decoded later or forwarded. Encoding a RawTerm writes it verbatim.
+type RawTerm []byte
+
+// Map is a generic representation of an Erlang map.
+// Erlang map keys can be any term, including tuples and binaries that cannot
+// be used as Go map keys, so the entries are kept as a list of key / value pairs.
+// If all your keys are atoms or binaries, you can simply decode to a Go map
+// with string keys or to a struct.
+type Map []MapEntry
+
+// MapEntry is a single key / value association in an Erlang map.
+type MapEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Get returns the value associated with key in the map.
+// Keys are compared using deep equality, so atoms must be passed as String atoms.
+func (m Map) Get(key interface{}) (interface{}, bool) {
+	for _, entry := range m {
+		if reflect.DeepEqual(entry.Key, key) {
+			return entry.Value, true
+		}
+	}
+	return nil, false
+}
+
+// String returns the map in Erlang syntax.
+func (m Map) String() string {
+	return formatString(m)
+}
+
+// ImproperList is an Erlang list whose tail is not the empty list, for example [a | b].
+// Elems must not be empty.
+type ImproperList struct {
+	Elems []interface{}
+	Tail  interface{}
+}
+
+// String returns the list in Erlang syntax.
+func (l ImproperList) String() string {
+	return formatString(l)
+}
+
 // Charlist is a wrapper structure to support Erlang charlist in encoding.
 // Charlist is only used in encoding. On decoding, charlists are always decoded
 // as strings.
@@ -91,6 +225,99 @@ type CharList struct {
 	Value string
 }
 
+// ============================================================================
+// Process, port and reference identifiers
+
+// Pid is an Erlang process identifier.
+type Pid struct {
+	Node     string
+	ID       uint32
+	Serial   uint32
+	Creation uint32
+}
+
+// String returns the pid as printed by Erlang, for example <0.123.0>.
+// The first number is an index the Erlang node assigns to remote nodes, so it
+// cannot be known outside of that node. We always print it as 0.
+func (pid Pid) String() string {
+	return fmt.Sprintf("<0.%d.%d>", pid.ID, pid.Serial)
+}
+
+// Port is an Erlang port identifier.
+type Port struct {
+	Node     string
+	ID       uint64
+	Creation uint32
+}
+
+// String returns the port as printed by Erlang, for example #Port<0.42>.
+func (port Port) String() string {
+	return fmt.Sprintf("#Port<0.%d>", port.ID)
+}
+
+// Ref is an Erlang reference, as returned by make_ref().
+type Ref struct {
+	Node     string
+	Creation uint32
+	// ID holds the words of the reference, least significant first, as they
+	// appear on the wire.
+	ID []uint32
+}
+
+// String returns the reference as printed by Erlang, for example #Ref<0.1776403624.3429089282.105563>.
+func (ref Ref) String() string {
+	var b strings.Builder
+	b.WriteString("#Ref<0")
+	for i := len(ref.ID) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, ".%d", ref.ID[i])
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// ============================================================================
+// Functions
+
+// Export is an external function reference, as created in Erlang with fun Module:Function/Arity.
+type Export struct {
+	Module   string
+	Function string
+	Arity    uint8
+}
+
+// String returns the external function as written in Erlang, for example fun lists:reverse/1.
+func (e Export) String() string {
+	return fmt.Sprintf("fun %s:%s/%d", e.Module, e.Function, e.Arity)
+}
+
+// Fun is an Erlang anonymous function.
+// A fun only makes sense for the Erlang node that created it, so it is opaque:
+// it can only be obtained by decoding an Erlang term, and it is encoded back exactly
+// as it was received.
+type Fun struct {
+	// Module is the module where the fun is defined.
+	Module string
+	Arity  uint8
+	// Index and Uniq identify the fun in its module.
+	Index uint32
+	Uniq  [16]byte
+	// OldIndex and OldUniq are the identifiers used by older Erlang releases.
+	OldIndex int64
+	OldUniq  int64
+	// Pid is the process that created the fun.
+	Pid Pid
+	// FreeVars holds the values of the variables captured by the fun, decoded as generic terms.
+	FreeVars []interface{}
+
+	// data is the original NEW_FUN_EXT encoding of the fun.
+	data []byte
+}
+
+// String returns a representation similar to the one printed by Erlang.
+func (f Fun) String() string {
+	return fmt.Sprintf("#Fun<%s.%d.%d>", f.Module, f.OldIndex, f.OldUniq)
+}
+
 // ============================================================================
 // Helpers
 // Short factory functions to help write short structure generation code.
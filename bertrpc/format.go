@@ -0,0 +1,330 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FormatOptions controls how terms are printed by Format.
+type FormatOptions struct {
+	// Pretty prints terms that do not fit on a line with one element per line,
+	// indented to their enclosing tuple, list or map, like io:format("~p").
+	Pretty bool
+	// Width is the maximum line width in pretty mode. It defaults to 80.
+	Width int
+}
+
+// Format returns a term in Erlang syntax, on a single line.
+// The term can be any value supported by Encode, and is printed as it would be
+// received by Erlang: atoms are quoted when needed, binaries are printed as <<"...">>
+// when they are printable, and lists of printable characters are printed as strings.
+func Format(term interface{}) (string, error) {
+	return FormatWithOptions(term, FormatOptions{})
+}
+
+// FormatWithOptions returns a term in Erlang syntax, using the given options.
+func FormatWithOptions(term interface{}, opts FormatOptions) (string, error) {
+	// Going through the encoding applies the same mapping rules as Encode
+	data, err := Encode(term)
+	if err != nil {
+		return "", err
+	}
+	var generic interface{}
+	if err := UnmarshalWithOptions(data, &generic, DecodeOptions{AliasBytes: true, Limits: unlimited}); err != nil {
+		return "", err
+	}
+
+	if opts.Width <= 0 {
+		opts.Width = 80
+	}
+	p := printer{opts: opts}
+	p.print(generic, 0)
+	return p.b.String(), nil
+}
+
+// formatString is used by the String methods of the generic term types.
+func formatString(term interface{}) string {
+	s, err := Format(term)
+	if err != nil {
+		return fmt.Sprintf("%%!(%v)", err)
+	}
+	return s
+}
+
+// printer writes generic terms, as returned by decodeTerm, in Erlang syntax.
+type printer struct {
+	opts FormatOptions
+	b    strings.Builder
+}
+
+// print writes a term starting at the given column, which is used in pretty mode
+// to indent the elements of nested terms.
+func (p *printer) print(term interface{}, col int) {
+	if p.opts.Pretty {
+		// Print the term on a single line if it fits
+		flat := printer{}
+		flat.print(term, 0)
+		if col+flat.b.Len() <= p.opts.Width {
+			p.b.WriteString(flat.b.String())
+			return
+		}
+	}
+
+	switch t := term.(type) {
+	case int64:
+		p.b.WriteString(strconv.FormatInt(t, 10))
+	case *big.Int:
+		p.b.WriteString(t.String())
+	case float64:
+		p.b.WriteString(formatFloat(t))
+	case String:
+		p.b.WriteString(quoteAtom(t.Value))
+	case []byte:
+		p.b.WriteString(formatBinary(t))
+	case BitString:
+		p.b.WriteString(formatBitString(t))
+	case Tuple:
+		p.printElems("{", t.Elems, nil, "}", col)
+	case List:
+		if s, ok := charList(t); ok {
+			p.b.WriteString(s)
+			return
+		}
+		p.printElems("[", t, nil, "]", col)
+	case ImproperList:
+		p.printElems("[", t.Elems, t.Tail, "]", col)
+	case Map:
+		p.printMap(t, col)
+	case Export:
+		fmt.Fprintf(&p.b, "fun %s:%s/%d", quoteAtom(t.Module), quoteAtom(t.Function), t.Arity)
+	case fmt.Stringer:
+		// Pid, Port, Ref and Fun
+		p.b.WriteString(t.String())
+	default:
+		fmt.Fprintf(&p.b, "%v", t)
+	}
+}
+
+// printElems writes the elements of a tuple or list, and the tail of an improper list.
+func (p *printer) printElems(open string, elems []interface{}, tail interface{}, close string, col int) {
+	p.b.WriteString(open)
+	col += len(open)
+	for i, elem := range elems {
+		if i > 0 {
+			p.separate(col)
+		}
+		p.print(elem, col)
+	}
+	if tail != nil {
+		p.b.WriteString("|")
+		p.print(tail, col+1)
+	}
+	p.b.WriteString(close)
+}
+
+func (p *printer) printMap(m Map, col int) {
+	p.b.WriteString("#{")
+	col += 2
+	for i, entry := range m {
+		if i > 0 {
+			p.separate(col)
+		}
+		start := p.b.Len()
+		p.print(entry.Key, col)
+		p.b.WriteString(" => ")
+		// The value is aligned after the key, unless the key spans several lines
+		keyLen := p.b.Len() - start
+		if nl := strings.LastIndexByte(p.b.String()[start:], '\n'); nl >= 0 {
+			keyLen = p.b.Len() - (start + nl + 1) - col
+		}
+		p.print(entry.Value, col+keyLen)
+	}
+	p.b.WriteString("}")
+}
+
+// separate writes the separator between elements, and the indentation in pretty mode.
+func (p *printer) separate(col int) {
+	p.b.WriteString(",")
+	if p.opts.Pretty {
+		p.b.WriteString("\n")
+		p.b.WriteString(strings.Repeat(" ", col))
+	}
+}
+
+// reservedWords are the Erlang keywords that must be quoted when used as atoms.
+var reservedWords = map[string]bool{
+	"after": true, "and": true, "andalso": true, "band": true, "begin": true, "bnot": true,
+	"bor": true, "bsl": true, "bsr": true, "bxor": true, "case": true, "catch": true,
+	"cond": true, "div": true, "else": true, "end": true, "fun": true, "if": true,
+	"let": true, "maybe": true, "not": true, "of": true, "or": true, "orelse": true,
+	"receive": true, "rem": true, "try": true, "when": true, "xor": true,
+}
+
+// quoteAtom returns an atom as written in Erlang, quoted only when needed.
+func quoteAtom(atom string) string {
+	if atom != "" && !reservedWords[atom] {
+		unquoted := true
+		for i, r := range atom {
+			if i == 0 && !isLower(r) || !isLower(r) && !isUpper(r) && !isDigit(r) && r != '_' && r != '@' {
+				unquoted = false
+				break
+			}
+		}
+		if unquoted {
+			return atom
+		}
+	}
+	return "'" + escape(atom, '\'') + "'"
+}
+
+// Erlang atoms can use Latin-1 letters without being quoted.
+func isLower(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 0xDF && r <= 0xFF && r != 0xF7
+}
+
+func isUpper(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 0xC0 && r <= 0xDE && r != 0xD7
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isPrintable reports whether a character is printed as is in Erlang strings,
+// using the default Latin-1 printable range.
+func isPrintable(r rune) bool {
+	return r >= 32 && r <= 126 || r >= 160 && r <= 255 || strings.ContainsRune("\n\r\t\v\b\f\x1b", r)
+}
+
+// escape escapes a string or atom content, delimited by quote.
+func escape(s string, quote rune) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case quote, '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\x1b':
+			b.WriteString(`\e`)
+		default:
+			if r < 32 || r == 127 {
+				fmt.Fprintf(&b, `\%03o`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// charList returns a list of printable characters as an Erlang string.
+func charList(list List) (string, bool) {
+	if len(list) == 0 {
+		return "", false
+	}
+	runes := make([]rune, len(list))
+	for i, elem := range list {
+		c, ok := elem.(int64)
+		if !ok || !isPrintable(rune(c)) {
+			return "", false
+		}
+		runes[i] = rune(c)
+	}
+	return `"` + escape(string(runes), '"') + `"`, true
+}
+
+// formatBinary prints a binary as a string if it is printable UTF-8 text,
+// or as a list of bytes.
+func formatBinary(data []byte) string {
+	if len(data) == 0 {
+		return "<<>>"
+	}
+	if utf8.Valid(data) {
+		printable, ascii := true, true
+		for _, r := range string(data) {
+			if r < 128 && !isPrintable(r) {
+				printable = false
+				break
+			}
+			ascii = ascii && r < 128
+		}
+		if printable && ascii {
+			return `<<"` + escape(string(data), '"') + `">>`
+		}
+		if printable {
+			return `<<"` + escape(string(data), '"') + `"/utf8>>`
+		}
+	}
+	return formatBytes(data, 8)
+}
+
+func formatBitString(b BitString) string {
+	if len(b.Bytes) == 0 || b.Bits == 8 {
+		return formatBinary(b.Bytes)
+	}
+	return formatBytes(b.Bytes, b.Bits)
+}
+
+// formatBytes prints bytes as integers. The last byte holds the given number of bits,
+// from its most significant bit.
+func formatBytes(data []byte, bits uint8) string {
+	var b strings.Builder
+	b.WriteString("<<")
+	for i, c := range data {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		if i == len(data)-1 && bits != 8 {
+			fmt.Fprintf(&b, "%d:%d", c>>(8-bits), bits)
+		} else {
+			b.WriteString(strconv.Itoa(int(c)))
+		}
+	}
+	b.WriteString(">>")
+	return b.String()
+}
+
+// formatFloat prints a float as Erlang does, with the shortest representation that
+// reads back to the same value, in decimal or scientific notation.
+func formatFloat(f float64) string {
+	decimal := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(decimal, ".") {
+		decimal += ".0"
+	}
+
+	// Erlang writes 1.0e-5 where Go writes 1e-05
+	sci := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp := sci[:strings.IndexByte(sci, 'e')], sci[strings.IndexByte(sci, 'e')+1:]
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	sign := ""
+	if exp[0] == '-' {
+		sign = "-"
+	}
+	exp = strings.TrimLeft(exp[1:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	sci = mantissa + "e" + sign + exp
+
+	if len(sci) < len(decimal) {
+		return sci
+	}
+	return decimal
+}
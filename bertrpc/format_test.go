@@ -0,0 +1,107 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"math/big"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+func TestFormat(t *testing.T) {
+	bigInt, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	var tests = []struct {
+		term     interface{}
+		expected string
+	}{
+		{42, "42"},
+		{-1, "-1"},
+		{bigInt, "-123456789012345678901234567890"},
+		{1.5, "1.5"},
+		{1.0, "1.0"},
+		{100000.0, "1.0e5"},
+		{123456.0, "123456.0"},
+		{0.000015, "1.5e-5"},
+		{bertrpc.A("ok"), "ok"},
+		{bertrpc.A("user@localhost"), "user@localhost"},
+		{bertrpc.A("Error"), "'Error'"},
+		{bertrpc.A("hello world"), "'hello world'"},
+		{bertrpc.A("it's"), `'it\'s'`},
+		{bertrpc.A("end"), "'end'"},
+		{bertrpc.A(""), "''"},
+		{bertrpc.A("été"), "été"},
+		{"john", `<<"john">>`},
+		{"say \"hi\"\n", `<<"say \"hi\"\n">>`},
+		{"été", `<<"été"/utf8>>`},
+		{[]byte{0, 1, 255}, "<<0,1,255>>"},
+		{[]byte{}, "<<>>"},
+		{bertrpc.BitString{Bytes: []byte{255, 128}, Bits: 1}, "<<255,1:1>>"},
+		{bertrpc.CharList{Value: "abc"}, `"abc"`},
+		{bertrpc.CharList{Value: ""}, "[]"},
+		{[]int{1, 2, 3}, "[1,2,3]"},
+		{[]int{104, 105}, `"hi"`},
+		{bertrpc.T(bertrpc.A("ok"), 1), "{ok,1}"},
+		{bertrpc.T(), "{}"},
+		{bertrpc.ImproperList{Elems: []interface{}{1, 2}, Tail: bertrpc.A("a")}, "[1,2|a]"},
+		{bertrpc.Map{{Key: bertrpc.A("a"), Value: 1}, {Key: "b", Value: bertrpc.L()}}, `#{a => 1,<<"b">> => []}`},
+		{bertrpc.Pid{Node: "nonode@nohost", ID: 80}, "<0.80.0>"},
+		{bertrpc.Port{Node: "nonode@nohost", ID: 42}, "#Port<0.42>"},
+		{bertrpc.Ref{Node: "nonode@nohost", ID: []uint32{3, 2, 1}}, "#Ref<0.1.2.3>"},
+		{bertrpc.Export{Module: "lists", Function: "map", Arity: 2}, "fun lists:map/2"},
+		{struct {
+			_    struct{} `erlang:"record=user"`
+			Name string
+			Age  int
+		}{Name: "john", Age: 42}, `{user,<<"john">>,42}`},
+	}
+
+	for _, tt := range tests {
+		s, err := bertrpc.Format(tt.term)
+		if err != nil {
+			t.Errorf("cannot format %v: %s", tt.term, err)
+			continue
+		}
+		if s != tt.expected {
+			t.Errorf("Format %#v: expected %s, actual %s", tt.term, tt.expected, s)
+		}
+	}
+}
+
+func TestFormatPretty(t *testing.T) {
+	type user struct {
+		_      struct{} `erlang:"record=user"`
+		Name   string
+		Groups []string
+	}
+	term := bertrpc.T(bertrpc.A("ok"), []user{
+		{Name: "john", Groups: []string{"friends", "work"}},
+		{Name: "jane", Groups: []string{"family"}},
+	}, bertrpc.Map{{Key: bertrpc.A("count"), Value: 2}})
+
+	opts := bertrpc.FormatOptions{Pretty: true, Width: 40}
+	s, err := bertrpc.FormatWithOptions(term, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{ok,
+ [{user,
+   <<"john">>,
+   [<<"friends">>,<<"work">>]},
+  {user,<<"jane">>,[<<"family">>]}],
+ #{count => 2}}`
+	if s != expected {
+		t.Errorf("FormatPretty: expected\n%s\nactual\n%s", expected, s)
+	}
+
+	// Short terms stay on one line
+	s, err = bertrpc.FormatWithOptions(bertrpc.T(bertrpc.A("ok"), 1), opts)
+	if err != nil || s != "{ok,1}" {
+		t.Errorf("FormatPretty: unexpected result %s, %v", s, err)
+	}
+}
+
+func TestTermString(t *testing.T) {
+	term := bertrpc.T(bertrpc.A("error"), bertrpc.L("reason", bertrpc.A("Exit")))
+	if s := term.String(); s != `{error,[<<"reason">>,'Exit']}` {
+		t.Errorf("incorrect tuple string: %s", s)
+	}
+}
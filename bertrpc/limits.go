@@ -0,0 +1,143 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Default decoding limits, used when the corresponding DecodeLimits field is zero.
+const (
+	DefaultMaxBytes      = 64 << 20
+	DefaultMaxBinarySize = 16 << 20
+	DefaultMaxElements   = 1 << 20
+	DefaultMaxDepth      = 1000
+)
+
+// DecodeLimits bounds the resources used to decode a term, so that untrusted input
+// cannot exhaust memory, like Erlang binary_to_term/2 with the safe option.
+// Limits are checked before anything is allocated for the data they apply to.
+// Zero fields use the default limits, and negative fields disable the limit.
+type DecodeLimits struct {
+	// MaxBytes is the maximum size of the encoded term, after decompression.
+	MaxBytes int
+	// MaxBinarySize is the maximum size of a binary or a bitstring, in bytes.
+	MaxBinarySize int
+	// MaxElements is the maximum number of elements of a list or a tuple, or of entries of a map.
+	MaxElements int
+	// MaxDepth is the maximum nesting depth of lists, tuples and maps.
+	MaxDepth int
+}
+
+// unlimited is used to decode trusted data produced by the application.
+var unlimited = DecodeLimits{MaxBytes: -1, MaxBinarySize: -1, MaxElements: -1, MaxDepth: -1}
+
+// LimitError is returned when a decoded term exceeds one of the DecodeLimits.
+type LimitError struct {
+	// Limit is the name of the exceeded DecodeLimits field.
+	Limit string
+	// Value is the size, count or depth that exceeds the limit.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("erlang term exceeds %s limit: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+func limit(value, def int) int64 {
+	switch {
+	case value > 0:
+		return int64(value)
+	case value < 0:
+		return math.MaxInt64
+	}
+	return int64(def)
+}
+
+// reserve accounts for n bytes about to be read, and checks them against MaxBytes.
+func (d *decodeState) reserve(n int) error {
+	if err := d.checkBytes(int64(n)); err != nil {
+		return err
+	}
+	d.bytes += int64(n)
+	return nil
+}
+
+// checkBytes checks that n more bytes can be read without exceeding MaxBytes.
+func (d *decodeState) checkBytes(n int64) error {
+	max := limit(d.opts.Limits.MaxBytes, DefaultMaxBytes)
+	if n > max-d.bytes {
+		return &LimitError{Limit: "MaxBytes", Value: d.bytes + n, Max: max}
+	}
+	return nil
+}
+
+// checkBinarySize checks the announced size of a binary or a bitstring.
+func (d *decodeState) checkBinarySize(n uint32) error {
+	max := limit(d.opts.Limits.MaxBinarySize, DefaultMaxBinarySize)
+	if int64(n) > max {
+		return &LimitError{Limit: "MaxBinarySize", Value: int64(n), Max: max}
+	}
+	return nil
+}
+
+// checkElements checks the announced number of elements of a list, tuple or map.
+// As each element takes one byte at least, the count is also checked against the
+// remaining input.
+func (d *decodeState) checkElements(n uint32) error {
+	max := limit(d.opts.Limits.MaxElements, DefaultMaxElements)
+	if int64(n) > max {
+		return &LimitError{Limit: "MaxElements", Value: int64(n), Max: max}
+	}
+	if d.r == nil && int(n) > len(d.data)-d.off {
+		return io.ErrUnexpectedEOF
+	}
+	return d.checkBytes(int64(n))
+}
+
+// readCount reads the 32 bits element count of a list or a map, and checks it.
+func (d *decodeState) readCount() (int, error) {
+	n, err := d.readUint32()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), d.checkElements(n)
+}
+
+// enter is called when decoding a nested list, tuple or map, to check the
+// nesting depth. It must be followed by a call to leave.
+func (d *decodeState) enter() error {
+	d.depth++
+	if max := limit(d.opts.Limits.MaxDepth, DefaultMaxDepth); int64(d.depth) > max {
+		return &LimitError{Limit: "MaxDepth", Value: int64(d.depth), Max: max}
+	}
+	return nil
+}
+
+func (d *decodeState) leave() {
+	d.depth--
+}
+
+// maxPrealloc is the maximum size, in bytes, allocated for the elements of a list,
+// tuple or map before they are decoded. Larger values grow as elements are decoded,
+// as the announced count is not checked against the input read from a stream, and
+// each element can use much more memory than the byte it takes at least.
+const maxPrealloc = 64 << 10
+
+// Sizes of the elements of generic terms.
+var (
+	termSize  = reflect.TypeOf((*interface{})(nil)).Elem().Size()
+	entrySize = reflect.TypeOf(MapEntry{}).Size()
+	runeSize  = reflect.TypeOf(rune(0)).Size()
+)
+
+// capacity returns the number of elements of the given size to preallocate for a
+// list, tuple or map announcing count elements.
+func capacity(count int, size uintptr) int {
+	if size > 0 && uintptr(count) > maxPrealloc/size {
+		return int(maxPrealloc / size)
+	}
+	return count
+}
@@ -0,0 +1,244 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"bytes"
+	"compress/zlib"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+// nestedLists returns depth nested lists: [[[...]]]
+func nestedLists(depth int) []byte {
+	data := []byte{131}
+	for i := 0; i < depth; i++ {
+		data = append(data, 108, 0, 0, 0, 1)
+	}
+	data = append(data, 106)
+	for i := 0; i < depth; i++ {
+		data = append(data, 106)
+	}
+	return data
+}
+
+func TestDecodeLimits(t *testing.T) {
+	var zlibHeader bytes.Buffer
+	zw := zlib.NewWriter(&zlibHeader)
+	_ = zw.Close()
+
+	tests := []struct {
+		name   string
+		input  []byte
+		limits bertrpc.DecodeLimits
+		limit  string
+	}{
+		{
+			name:  "huge binary",
+			input: []byte{131, 109, 255, 255, 255, 255},
+			limit: "MaxBinarySize",
+		},
+		{
+			name:  "huge bitstring",
+			input: []byte{131, 77, 255, 255, 255, 255, 1},
+			limit: "MaxBinarySize",
+		},
+		{
+			name:  "huge list",
+			input: []byte{131, 108, 255, 255, 255, 255},
+			limit: "MaxElements",
+		},
+		{
+			name:  "huge tuple",
+			input: []byte{131, 105, 255, 255, 255, 255},
+			limit: "MaxElements",
+		},
+		{
+			name:  "huge map",
+			input: []byte{131, 116, 255, 255, 255, 255},
+			limit: "MaxElements",
+		},
+		{
+			name:  "huge compressed term",
+			input: append([]byte{131, 80, 255, 255, 255, 255}, zlibHeader.Bytes()...),
+			limit: "MaxBytes",
+		},
+		{
+			name:  "deep nesting",
+			input: nestedLists(bertrpc.DefaultMaxDepth + 1),
+			limit: "MaxDepth",
+		},
+		{
+			name:   "custom binary size",
+			input:  []byte{131, 109, 0, 0, 0, 4, 106, 111, 104, 110},
+			limits: bertrpc.DecodeLimits{MaxBinarySize: 3},
+			limit:  "MaxBinarySize",
+		},
+		{
+			name:   "custom element count",
+			input:  []byte{131, 108, 0, 0, 0, 2, 97, 1, 97, 2, 106},
+			limits: bertrpc.DecodeLimits{MaxElements: 1},
+			limit:  "MaxElements",
+		},
+		{
+			name:   "custom depth",
+			input:  nestedLists(3),
+			limits: bertrpc.DecodeLimits{MaxDepth: 2},
+			limit:  "MaxDepth",
+		},
+		{
+			name:   "custom total size",
+			input:  []byte{131, 108, 0, 0, 0, 2, 97, 1, 97, 2, 106},
+			limits: bertrpc.DecodeLimits{MaxBytes: 8},
+			limit:  "MaxBytes",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			opts := bertrpc.DecodeOptions{Limits: tc.limits}
+			dec := bertrpc.NewDecoder(bytes.NewReader(tc.input))
+			dec.SetOptions(opts)
+			var term interface{}
+			for name, err := range map[string]error{
+				"Decoder":   dec.Decode(&term),
+				"Unmarshal": bertrpc.UnmarshalWithOptions(tc.input, &term, opts),
+			} {
+				lerr, ok := err.(*bertrpc.LimitError)
+				if !ok {
+					st.Errorf("%s: expected LimitError, got: %v", name, err)
+					continue
+				}
+				if lerr.Limit != tc.limit {
+					st.Errorf("%s: expected %s limit, got: %v", name, tc.limit, lerr)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeLimitsTypedTargets(t *testing.T) {
+	opts := bertrpc.DecodeOptions{Limits: bertrpc.DecodeLimits{MaxDepth: 2, MaxElements: 2}}
+
+	var deep [][][]int
+	err := bertrpc.UnmarshalWithOptions(nestedLists(3), &deep, opts)
+	if lerr, ok := err.(*bertrpc.LimitError); !ok || lerr.Limit != "MaxDepth" {
+		t.Errorf("expected MaxDepth LimitError, got: %v", err)
+	}
+
+	var list []int
+	err = bertrpc.UnmarshalWithOptions([]byte{131, 108, 0, 0, 0, 3, 97, 1, 97, 2, 97, 3, 106}, &list, opts)
+	if lerr, ok := err.(*bertrpc.LimitError); !ok || lerr.Limit != "MaxElements" {
+		t.Errorf("expected MaxElements LimitError, got: %v", err)
+	}
+}
+
+func TestDecodeLimitsDisabled(t *testing.T) {
+	input := nestedLists(bertrpc.DefaultMaxDepth + 1)
+	var term interface{}
+	opts := bertrpc.DecodeOptions{Limits: bertrpc.DecodeLimits{MaxDepth: -1}}
+	if err := bertrpc.UnmarshalWithOptions(input, &term, opts); err != nil {
+		t.Errorf("negative limits should be disabled: %v", err)
+	}
+}
+
+// Terms produced by the application are trusted, and are not limited in depth.
+func TestTrustedTermsDepth(t *testing.T) {
+	depth := bertrpc.DefaultMaxDepth + 1
+	input := nestedLists(depth)
+	var term interface{}
+	opts := bertrpc.DecodeOptions{Limits: bertrpc.DecodeLimits{MaxDepth: -1}}
+	if err := bertrpc.UnmarshalWithOptions(input, &term, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Repeat("[", depth+1) + strings.Repeat("]", depth+1)
+	text, err := bertrpc.Format(term)
+	if err != nil {
+		t.Errorf("cannot format deep term: %v", err)
+	}
+	if text != want {
+		t.Errorf("incorrect formatted term: %s", text)
+	}
+
+	var terms []interface{}
+	if err := bertrpc.ConsultTo(strings.NewReader(want+"."), &terms); err != nil {
+		t.Errorf("cannot consult deep term: %v", err)
+	}
+
+	data, err := bertrpc.EncodeWithOptions(bertrpc.RawTerm(input), bertrpc.EncodeOptions{Deterministic: true})
+	if err != nil {
+		t.Errorf("cannot encode deep raw term: %v", err)
+	}
+	if !bytes.Equal(data, input) {
+		t.Errorf("incorrect deterministic encoding of deep raw term")
+	}
+}
+
+func TestDecodeLimitsExactSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "list", input: []byte{131, 108, 0, 0, 0, 2, 97, 1, 97, 2, 106}},
+		{name: "fun", input: funTerm()},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			// The whole input, including the version tag, is counted once
+			var term interface{}
+			opts := bertrpc.DecodeOptions{Limits: bertrpc.DecodeLimits{MaxBytes: len(tc.input)}}
+			if err := bertrpc.UnmarshalWithOptions(tc.input, &term, opts); err != nil {
+				st.Errorf("term at the exact size limit should be decoded: %v", err)
+			}
+			dec := bertrpc.NewDecoder(bytes.NewReader(tc.input))
+			dec.SetOptions(opts)
+			if err := dec.Decode(&term); err != nil {
+				st.Errorf("term at the exact size limit should be decoded from a stream: %v", err)
+			}
+
+			opts.Limits.MaxBytes--
+			err := bertrpc.UnmarshalWithOptions(tc.input, &term, opts)
+			if lerr, ok := err.(*bertrpc.LimitError); !ok || lerr.Limit != "MaxBytes" {
+				st.Errorf("expected MaxBytes LimitError, got: %v", err)
+			}
+		})
+	}
+}
+
+// Element counts read from a stream are not checked against the input: memory is
+// allocated as elements are decoded.
+func TestDecodeStreamPrealloc(t *testing.T) {
+	// Lists of DefaultMaxElements elements, truncated after their header
+	header := []byte{108, 0, 16, 0, 0}
+	nested := []byte{131}
+	for i := 0; i < 40; i++ {
+		nested = append(nested, header...)
+	}
+	tests := []struct {
+		name   string
+		input  []byte
+		target func() interface{}
+	}{
+		{name: "generic", input: nested, target: func() interface{} { return new(interface{}) }},
+		{name: "map", input: []byte{131, 116, 0, 16, 0, 0}, target: func() interface{} { return new(bertrpc.Map) }},
+		{name: "typed slice", input: append([]byte{131}, header...), target: func() interface{} { return new([][1 << 16]byte) }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := bertrpc.NewDecoder(bytes.NewReader(tc.input)).Decode(tc.target())
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				st.Errorf("truncated term should not be decoded")
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 8<<20 {
+				st.Errorf("%d bytes allocated to decode %d bytes", n, len(tc.input))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ErlangMarshaler is the interface implemented by types that can encode themselves
+// as an Erlang term.
+// MarshalErlang returns the term in Erlang External Term Format, including the version
+// tag, as returned by Encode.
+type ErlangMarshaler interface {
+	MarshalErlang() ([]byte, error)
+}
+
+// ErlangUnmarshaler is the interface implemented by types that can decode an Erlang
+// term representation of themselves.
+// UnmarshalErlang receives a single term in Erlang External Term Format, including the
+// version tag, that can be passed to Decode. It must copy the data if it wishes to
+// retain it after returning.
+type ErlangUnmarshaler interface {
+	UnmarshalErlang([]byte) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*ErlangMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*ErlangUnmarshaler)(nil)).Elem()
+)
+
+// marshaler returns the ErlangMarshaler implementation of a term, if any.
+// Methods with pointer receivers are supported, by working on a copy of the term.
+func marshaler(term interface{}) (ErlangMarshaler, bool) {
+	if m, ok := term.(ErlangMarshaler); ok {
+		v := reflect.ValueOf(term)
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, false
+		}
+		return m, true
+	}
+
+	v := reflect.ValueOf(term)
+	if !v.IsValid() || v.Kind() == reflect.Ptr || !reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return nil, false
+	}
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	return ptr.Interface().(ErlangMarshaler), true
+}
+
+func (e *encodeState) encodeMarshaler(m ErlangMarshaler) error {
+	data, err := m.MarshalErlang()
+	if err != nil {
+		return fmt.Errorf("error calling MarshalErlang for type %T: %v", m, err)
+	}
+	if err := e.encodeRawTerm(data); err != nil {
+		return fmt.Errorf("invalid term returned by MarshalErlang for type %T: %v", m, err)
+	}
+	return nil
+}
+
+// encodeRawTerm writes an encoded term, without its version tag. Compressed terms
+// are inflated. The data must contain exactly one term.
+// With deterministic encoding, the term is decoded and encoded again.
+func (e *encodeState) encodeRawTerm(data []byte) error {
+	d := &decodeState{data: data, opts: DecodeOptions{Limits: unlimited}}
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	start := d.off
+	if err := d.skipTerm(); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return fmt.Errorf("%d bytes of trailing data after term", len(d.data)-d.off)
+	}
+	if e.opts.Deterministic {
+		d.off = start
+		term, err := d.decodeTerm()
+		if err != nil {
+			return err
+		}
+		return e.encodePayloadTo(term)
+	}
+	e.buf.Write(d.data[start:])
+	return nil
+}
+
+// unmarshaler returns the ErlangUnmarshaler implementation of a decoding target, if any.
+// Pointer targets are resolved by decodeData before.
+func unmarshaler(val reflect.Value) (ErlangUnmarshaler, bool) {
+	if val.CanAddr() && val.Addr().Type().Implements(unmarshalerType) {
+		return val.Addr().Interface().(ErlangUnmarshaler), true
+	}
+	return nil, false
+}
+
+// decodeUnmarshaler reads the next term and passes its encoding to the unmarshaler.
+func (d *decodeState) decodeUnmarshaler(u ErlangUnmarshaler) error {
+	data, err := d.rawTerm()
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalErlang(data)
+}
@@ -0,0 +1,137 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+// jid is sent to Erlang as {jid, User, Server}
+type jid struct {
+	User   string
+	Server string
+}
+
+func (j jid) MarshalErlang() ([]byte, error) {
+	return bertrpc.Encode(bertrpc.T(bertrpc.A("jid"), j.User, j.Server))
+}
+
+func (j *jid) UnmarshalErlang(data []byte) error {
+	var t struct {
+		Tag    string
+		User   string
+		Server string
+	}
+	if err := bertrpc.Decode(bytes.NewReader(data), &t); err != nil {
+		return err
+	}
+	if t.Tag != "jid" {
+		return errors.New("not a jid")
+	}
+	j.User, j.Server = t.User, t.Server
+	return nil
+}
+
+// uuid is sent to Erlang as a 16 bytes binary, and implements MarshalErlang with a pointer receiver.
+type uuid [16]byte
+
+func (u *uuid) MarshalErlang() ([]byte, error) {
+	return bertrpc.Encode(u[:])
+}
+
+func (u *uuid) UnmarshalErlang(data []byte) error {
+	var b []byte
+	if err := bertrpc.Decode(bytes.NewReader(data), &b); err != nil {
+		return err
+	}
+	if len(b) != 16 {
+		return errors.New("invalid uuid")
+	}
+	copy(u[:], b)
+	return nil
+}
+
+// {jid, <<"john">>, <<"localhost">>}
+var jidTerm = []byte{104, 3, 119, 3, 106, 105, 100, 109, 0, 0, 0, 4, 106, 111, 104, 110, 109, 0, 0, 0, 9, 108, 111,
+	99, 97, 108, 104, 111, 115, 116}
+
+func TestEncodeMarshaler(t *testing.T) {
+	data, err := bertrpc.Encode(jid{"john", "localhost"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := append([]byte{131}, jidTerm...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeMarshaler: expected %v, actual %v", expected, data)
+	}
+}
+
+func TestEncodeNestedMarshaler(t *testing.T) {
+	id := uuid{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	// Pointer receiver is used on values, and marshalers are used inside other terms
+	data, err := bertrpc.Encode(bertrpc.T(id, bertrpc.L(jid{"john", "localhost"})))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := bytes.Join([][]byte{
+		{131, 104, 2, 109, 0, 0, 0, 16}, id[:],
+		{108, 0, 0, 0, 1}, jidTerm, {106},
+	}, nil)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("EncodeNestedMarshaler: expected %v, actual %v", expected, data)
+	}
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalErlang() ([]byte, error) {
+	return nil, errors.New("failure")
+}
+
+func TestEncodeMarshalerError(t *testing.T) {
+	_, err := bertrpc.Encode(bertrpc.T(failingMarshaler{}))
+	if err == nil || !strings.Contains(err.Error(), "failure") {
+		t.Errorf("marshaler error should be returned: %v", err)
+	}
+}
+
+func TestDecodeUnmarshaler(t *testing.T) {
+	var j jid
+	if err := bertrpc.Decode(bytes.NewReader(append([]byte{131}, jidTerm...)), &j); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if j != (jid{"john", "localhost"}) {
+		t.Errorf("incorrect result: %#v", j)
+	}
+}
+
+func TestDecodeNestedUnmarshaler(t *testing.T) {
+	id := uuid{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	// {UUID, [JID]}
+	input := bytes.Join([][]byte{
+		{131, 104, 2, 109, 0, 0, 0, 16}, id[:],
+		{108, 0, 0, 0, 1}, jidTerm, {106},
+	}, nil)
+
+	var res struct {
+		ID   uuid
+		JIDs []*jid
+	}
+	if err := bertrpc.Decode(bytes.NewReader(input), &res); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if res.ID != id {
+		t.Errorf("incorrect id: %v", res.ID)
+	}
+	if !reflect.DeepEqual(res.JIDs, []*jid{{"john", "localhost"}}) {
+		t.Errorf("incorrect jids: %v", res.JIDs)
+	}
+}
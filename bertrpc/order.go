@@ -0,0 +1,292 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Erlang term order, between the types of terms:
+// number < atom < reference < fun < port < pid < tuple < map < nil < list < bit string
+const (
+	orderInteger = iota
+	orderFloat
+	orderAtom
+	orderRef
+	orderFun
+	orderPort
+	orderPid
+	orderTuple
+	orderMap
+	orderList
+	orderBitString
+)
+
+// compareTerms compares generic terms, as returned by decodeTerm, in Erlang term order.
+// It returns -1, 0 or 1. Like map keys in Erlang, integers are considered less than floats,
+// so that terms are only equal when they have the same encoding.
+func compareTerms(a, b interface{}) int {
+	if oa, ob := typeOrder(a), typeOrder(b); oa != ob {
+		return compareInts(int64(oa), int64(ob))
+	}
+
+	switch x := a.(type) {
+	case int64, *big.Int:
+		return bigInt(x).Cmp(bigInt(b))
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		// -0.0 is less than 0.0
+		return compareBools(!math.Signbit(x), !math.Signbit(y))
+	case String:
+		return strings.Compare(x.Value, b.(String).Value)
+	case Ref:
+		y := b.(Ref)
+		if c := strings.Compare(x.Node, y.Node); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(len(x.ID)), int64(len(y.ID))); c != 0 {
+			return c
+		}
+		// Most significant words come last
+		for i := len(x.ID) - 1; i >= 0; i-- {
+			if c := compareInts(int64(x.ID[i]), int64(y.ID[i])); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(x.Creation), int64(y.Creation))
+	case Fun:
+		y, ok := b.(Fun)
+		if !ok {
+			// Local funs come before external funs
+			return -1
+		}
+		if c := strings.Compare(x.Module, y.Module); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(x.Index), int64(y.Index)); c != 0 {
+			return c
+		}
+		return bytes.Compare(x.Uniq[:], y.Uniq[:])
+	case Export:
+		y, ok := b.(Export)
+		if !ok {
+			return 1
+		}
+		if c := strings.Compare(x.Module, y.Module); c != 0 {
+			return c
+		}
+		if c := strings.Compare(x.Function, y.Function); c != 0 {
+			return c
+		}
+		return compareInts(int64(x.Arity), int64(y.Arity))
+	case Port:
+		y := b.(Port)
+		if c := strings.Compare(x.Node, y.Node); c != 0 {
+			return c
+		}
+		if c := compareBools(x.ID > y.ID, x.ID < y.ID); c != 0 {
+			return c
+		}
+		return compareInts(int64(x.Creation), int64(y.Creation))
+	case Pid:
+		y := b.(Pid)
+		if c := strings.Compare(x.Node, y.Node); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(x.Serial), int64(y.Serial)); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(x.ID), int64(y.ID)); c != 0 {
+			return c
+		}
+		return compareInts(int64(x.Creation), int64(y.Creation))
+	case Tuple:
+		y := b.(Tuple)
+		if c := compareInts(int64(len(x.Elems)), int64(len(y.Elems))); c != 0 {
+			return c
+		}
+		return compareElems(x.Elems, y.Elems)
+	case Map:
+		// Maps are compared by size, then keys, then values in key order.
+		// Decoded maps come from the deterministic encoding, so their keys are sorted.
+		y := b.(Map)
+		if c := compareInts(int64(len(x)), int64(len(y))); c != 0 {
+			return c
+		}
+		for i := range x {
+			if c := compareTerms(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+		}
+		for i := range x {
+			if c := compareTerms(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return 0
+	case List, ImproperList:
+		return compareLists(a, b)
+	case []byte, BitString:
+		return compareBitStrings(bitString(a), bitString(b))
+	}
+	return 0
+}
+
+func typeOrder(term interface{}) int {
+	switch term.(type) {
+	case int64, *big.Int:
+		return orderInteger
+	case float64:
+		return orderFloat
+	case String:
+		return orderAtom
+	case Ref:
+		return orderRef
+	case Fun, Export:
+		return orderFun
+	case Port:
+		return orderPort
+	case Pid:
+		return orderPid
+	case Tuple:
+		return orderTuple
+	case Map:
+		return orderMap
+	case List, ImproperList:
+		// Nil is the empty list, and is less than any other list
+		return orderList
+	}
+	return orderBitString
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareBools returns 1 when only a is true, and -1 when only b is true.
+func compareBools(a, b bool) int {
+	switch {
+	case a && !b:
+		return 1
+	case b && !a:
+		return -1
+	}
+	return 0
+}
+
+func bigInt(term interface{}) *big.Int {
+	if i, ok := term.(int64); ok {
+		return big.NewInt(i)
+	}
+	return term.(*big.Int)
+}
+
+func compareElems(a, b []interface{}) int {
+	for i := range a {
+		if c := compareTerms(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareLists compares lists element by element, then by their tails, so that
+// a list is greater than its prefixes.
+func compareLists(a, b interface{}) int {
+	aElems, aTail := listParts(a)
+	bElems, bTail := listParts(b)
+	n := len(aElems)
+	if len(bElems) < n {
+		n = len(bElems)
+	}
+	if c := compareElems(aElems[:n], bElems[:n]); c != 0 {
+		return c
+	}
+
+	aDone, bDone := n == len(aElems), n == len(bElems)
+	switch {
+	case aDone && bDone:
+		if aTail == nil && bTail == nil {
+			return 0
+		}
+		return compareTerms(tailTerm(aTail), tailTerm(bTail))
+	case aDone:
+		// The rest of b is a non empty list
+		if aTail == nil {
+			return -1
+		}
+		return compareTerms(aTail, listRest(bElems[n:], bTail))
+	default:
+		if bTail == nil {
+			return 1
+		}
+		return compareTerms(listRest(aElems[n:], aTail), bTail)
+	}
+}
+
+// listParts returns the elements of a list, and its tail, which is nil for a proper list.
+func listParts(term interface{}) ([]interface{}, interface{}) {
+	if l, ok := term.(ImproperList); ok {
+		return l.Elems, l.Tail
+	}
+	return term.(List), nil
+}
+
+// listRest returns the remaining elements of a list with its tail, as a term.
+func listRest(elems []interface{}, tail interface{}) interface{} {
+	if tail != nil {
+		return ImproperList{Elems: elems, Tail: tail}
+	}
+	return List(elems)
+}
+
+// tailTerm returns the tail of a list as a term, the tail of proper lists being nil.
+func tailTerm(tail interface{}) interface{} {
+	if tail == nil {
+		return List{}
+	}
+	return tail
+}
+
+func bitString(term interface{}) BitString {
+	if data, ok := term.([]byte); ok {
+		return BitString{Bytes: data, Bits: 8}
+	}
+	return term.(BitString)
+}
+
+// compareBitStrings compares bit strings bit by bit. A bit string is greater than its prefixes.
+func compareBitStrings(a, b BitString) int {
+	aLen, bLen := a.BitLen(), b.BitLen()
+	n := aLen
+	if bLen < n {
+		n = bLen
+	}
+	if c := bytes.Compare(a.Bytes[:n/8], b.Bytes[:n/8]); c != 0 {
+		return c
+	}
+	for i := n / 8 * 8; i < n; i++ {
+		if c := compareInts(int64(bit(a.Bytes, i)), int64(bit(b.Bytes, i))); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(aLen), int64(bLen))
+}
+
+// bit returns the bit at the given position, starting from the most significant bit.
+func bit(data []byte, i int) byte {
+	return data[i/8] >> (7 - uint(i%8)) & 1
+}
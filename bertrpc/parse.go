@@ -0,0 +1,608 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxError is returned when parsing invalid Erlang term text.
+type SyntaxError struct {
+	Msg string
+	// Line and Column give the position of the error, starting at 1.
+	Line   int
+	Column int
+	// Term is the number of the invalid term, starting at 1, when reading a sequence
+	// of terms with Consult. It is 0 otherwise.
+	Term int
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Term > 0 {
+		return fmt.Sprintf("%d:%d: term %d: %s", e.Line, e.Column, e.Term, e.Msg)
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// ParseTerm parses an Erlang term written in Erlang syntax, like erl_parse:parse_term.
+// The term can be followed by a dot. Comments are ignored.
+//
+// Supported terms are atoms, integers (including Base#Digits and $c notations),
+// floats, strings, binaries, tuples, lists, improper lists and maps.
+// The returned value is the same as decoding the encoded term to an empty interface:
+// atoms are returned as String, integers as int64 or *big.Int, strings as List of
+// integers, binaries as []byte, tuples as Tuple, lists as List or ImproperList
+// and maps as Map.
+func ParseTerm(text string) (interface{}, error) {
+	p := newParser(text)
+	term, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '.' {
+		p.next()
+	}
+	if p.skipSpace(); !p.eof() {
+		return nil, p.errorf("unexpected %s after term", p.describe())
+	}
+	return term, nil
+}
+
+// parser reads Erlang terms from text, keeping track of the position for errors.
+type parser struct {
+	text string
+	pos  int
+	line int
+	col  int
+}
+
+func newParser(text string) *parser {
+	return &parser{text: text, line: 1, col: 1}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.text)
+}
+
+// peek returns the next character, or -1 at the end of the text.
+func (p *parser) peek() rune {
+	if p.eof() {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(p.text[p.pos:])
+	return r
+}
+
+// peekString reports whether the text continues with s.
+func (p *parser) peekString(s string) bool {
+	return strings.HasPrefix(p.text[p.pos:], s)
+}
+
+func (p *parser) next() rune {
+	if p.eof() {
+		return -1
+	}
+	r, size := utf8.DecodeRuneInString(p.text[p.pos:])
+	p.pos += size
+	if r == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	return r
+}
+
+// skipSpace skips white space and comments.
+func (p *parser) skipSpace() {
+	for !p.eof() {
+		switch r := p.peek(); {
+		case r == '%':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\v':
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Msg: fmt.Sprintf(format, args...), Line: p.line, Column: p.col}
+}
+
+// describe returns the next character for error messages.
+func (p *parser) describe() string {
+	if p.eof() {
+		return "end of input"
+	}
+	return strconv.QuoteRune(p.peek())
+}
+
+// expect skips white space and reads the given token.
+func (p *parser) expect(token string) error {
+	p.skipSpace()
+	if !p.peekString(token) {
+		return p.errorf("expected %q, found %s", token, p.describe())
+	}
+	for range token {
+		p.next()
+	}
+	return nil
+}
+
+func (p *parser) parseTerm() (interface{}, error) {
+	p.skipSpace()
+	switch r := p.peek(); {
+	case r == '{':
+		p.next()
+		elems, err := p.parseElems('}')
+		if err != nil {
+			return nil, err
+		}
+		return Tuple{Elems: elems}, nil
+	case r == '[':
+		p.next()
+		return p.parseList()
+	case r == '#':
+		p.next()
+		if err := p.expect("{"); err != nil {
+			return nil, err
+		}
+		return p.parseMap()
+	case p.peekString("<<"):
+		p.next()
+		p.next()
+		return p.parseBinary()
+	case r == '"':
+		s, err := p.parseStrings()
+		if err != nil {
+			return nil, err
+		}
+		list := make(List, 0, len(s))
+		for _, c := range s {
+			list = append(list, int64(c))
+		}
+		return list, nil
+	case r == '\'':
+		s, err := p.parseQuoted('\'')
+		return A(s), err
+	case r == '$':
+		p.next()
+		c, err := p.parseChar()
+		return int64(c), err
+	case r == '-' || r == '+' || isDigit(r):
+		return p.parseNumber()
+	case isLower(r):
+		start, line, col := p.pos, p.line, p.col
+		for r := p.peek(); isLower(r) || isUpper(r) || isDigit(r) || r == '_' || r == '@'; r = p.peek() {
+			p.next()
+		}
+		atom := p.text[start:p.pos]
+		if reservedWords[atom] {
+			return nil, &SyntaxError{Msg: fmt.Sprintf("reserved word %s must be quoted to be used as an atom", atom), Line: line, Column: col}
+		}
+		return A(atom), nil
+	case isUpper(r) || r == '_':
+		return nil, p.errorf("variables are not allowed in terms")
+	}
+	return nil, p.errorf("unexpected %s", p.describe())
+}
+
+// parseElems parses comma separated terms, up to the closing character.
+func (p *parser) parseElems(closing rune) ([]interface{}, error) {
+	elems := []interface{}{}
+	p.skipSpace()
+	if p.peek() == closing {
+		p.next()
+		return elems, nil
+	}
+	for {
+		elem, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case closing:
+			p.next()
+			return elems, nil
+		default:
+			return nil, p.errorf("expected ',' or %q, found %s", closing, p.describe())
+		}
+	}
+}
+
+// parseList parses a list after its opening bracket. Lists can have a tail: [a, b | T].
+func (p *parser) parseList() (interface{}, error) {
+	list := List{}
+	p.skipSpace()
+	if p.peek() == ']' {
+		p.next()
+		return list, nil
+	}
+	for {
+		elem, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+			p.next()
+			return list, nil
+		case '|':
+			p.next()
+			tail, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return appendTail(list, tail), nil
+		default:
+			return nil, p.errorf("expected ',', '|' or ']', found %s", p.describe())
+		}
+	}
+}
+
+// appendTail returns the list with the given tail, which makes it improper unless the
+// tail is itself a list.
+func appendTail(list List, tail interface{}) interface{} {
+	switch t := tail.(type) {
+	case List:
+		return append(list, t...)
+	case ImproperList:
+		return ImproperList{Elems: append([]interface{}(list), t.Elems...), Tail: t.Tail}
+	}
+	return ImproperList{Elems: list, Tail: tail}
+}
+
+// parseMap parses a map after its opening #{.
+func (p *parser) parseMap() (interface{}, error) {
+	m := Map{}
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.next()
+		return m, nil
+	}
+	for {
+		key, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("=>"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, MapEntry{Key: key, Value: value})
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case '}':
+			p.next()
+			return m, nil
+		default:
+			return nil, p.errorf("expected ',' or '}', found %s", p.describe())
+		}
+	}
+}
+
+// parseBinary parses a binary after its opening <<. Segments are integers, characters
+// or strings, optionally with the utf8 type: <<1, $a, "text", "été"/utf8>>.
+// Without utf8, values are truncated to a byte, as in Erlang.
+func (p *parser) parseBinary() (interface{}, error) {
+	data := []byte{}
+	p.skipSpace()
+	if p.peekString(">>") {
+		p.next()
+		p.next()
+		return data, nil
+	}
+	for {
+		p.skipSpace()
+		var values []rune
+		switch r := p.peek(); {
+		case r == '"':
+			s, err := p.parseStrings()
+			if err != nil {
+				return nil, err
+			}
+			values = []rune(s)
+		case r == '$':
+			p.next()
+			c, err := p.parseChar()
+			if err != nil {
+				return nil, err
+			}
+			values = []rune{c}
+		case r == '-' || isDigit(r):
+			n, err := p.parseNumber()
+			if err != nil {
+				return nil, err
+			}
+			i, ok := n.(int64)
+			if !ok {
+				return nil, p.errorf("unsupported binary segment %v", n)
+			}
+			values = []rune{rune(i)}
+		default:
+			return nil, p.errorf("unsupported binary segment starting with %s", p.describe())
+		}
+
+		p.skipSpace()
+		if p.peek() == '/' {
+			p.next()
+			if err := p.expect("utf8"); err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				if !utf8.ValidRune(v) {
+					return nil, p.errorf("invalid utf8 character %d", v)
+				}
+				data = append(data, string(v)...)
+			}
+		} else {
+			for _, v := range values {
+				data = append(data, byte(v))
+			}
+		}
+
+		p.skipSpace()
+		switch {
+		case p.peek() == ',':
+			p.next()
+		case p.peekString(">>"):
+			p.next()
+			p.next()
+			return data, nil
+		default:
+			return nil, p.errorf("expected ',' or '>>', found %s", p.describe())
+		}
+	}
+}
+
+// parseStrings parses a string, and the strings that immediately follow it:
+// "abc" "def" is the same as "abcdef".
+func (p *parser) parseStrings() (string, error) {
+	var b strings.Builder
+	for {
+		s, err := p.parseQuoted('"')
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		p.skipSpace()
+		if p.peek() != '"' {
+			return b.String(), nil
+		}
+	}
+}
+
+// parseQuoted parses a quoted atom or string.
+func (p *parser) parseQuoted(quote rune) (string, error) {
+	p.next()
+	var b strings.Builder
+	for {
+		switch r := p.peek(); r {
+		case -1:
+			return "", p.errorf("unterminated %c quoted text", quote)
+		case quote:
+			p.next()
+			return b.String(), nil
+		default:
+			c, err := p.parseChar()
+			if err != nil {
+				return "", err
+			}
+			b.WriteRune(c)
+		}
+	}
+}
+
+// parseChar parses a character, which can be an escape sequence.
+func (p *parser) parseChar() (rune, error) {
+	r := p.next()
+	switch r {
+	case -1:
+		return 0, p.errorf("unexpected end of input")
+	case '\\':
+	default:
+		return r, nil
+	}
+
+	r = p.next()
+	switch r {
+	case 'b':
+		return '\b', nil
+	case 'd':
+		return 127, nil
+	case 'e':
+		return 27, nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 's':
+		return ' ', nil
+	case 't':
+		return '\t', nil
+	case 'v':
+		return '\v', nil
+	case '^':
+		c := p.next()
+		if c == -1 {
+			return 0, p.errorf("unexpected end of input")
+		}
+		return c & 31, nil
+	case 'x':
+		if p.peek() == '{' {
+			p.next()
+			start := p.pos
+			for isHexDigit(p.peek()) {
+				p.next()
+			}
+			digits := p.text[start:p.pos]
+			if p.next() != '}' {
+				return 0, p.errorf("invalid \\x{...} escape sequence")
+			}
+			c, err := strconv.ParseUint(digits, 16, 32)
+			if err != nil {
+				return 0, p.errorf("invalid \\x{%s} escape sequence", digits)
+			}
+			return rune(c), nil
+		}
+		start := p.pos
+		for i := 0; i < 2 && isHexDigit(p.peek()); i++ {
+			p.next()
+		}
+		if p.pos-start != 2 {
+			return 0, p.errorf("invalid \\x escape sequence")
+		}
+		c, _ := strconv.ParseUint(p.text[start:p.pos], 16, 8)
+		return rune(c), nil
+	case -1:
+		return 0, p.errorf("unexpected end of input")
+	}
+	if r >= '0' && r <= '7' {
+		c := r - '0'
+		for i := 0; i < 2 && p.peek() >= '0' && p.peek() <= '7'; i++ {
+			c = c*8 + p.next() - '0'
+		}
+		return c, nil
+	}
+	// Other characters are escaped as themselves: \\, \', \"
+	return r, nil
+}
+
+func isHexDigit(r rune) bool {
+	return isDigit(r) || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F'
+}
+
+// parseNumber parses an integer or a float, with an optional sign.
+// Integers can be written as Base#Digits, and digits can be separated by underscores.
+func (p *parser) parseNumber() (interface{}, error) {
+	line, col := p.line, p.col
+	numberError := func(format string, args ...interface{}) error {
+		return &SyntaxError{Msg: fmt.Sprintf(format, args...), Line: line, Column: col}
+	}
+
+	sign := ""
+	if r := p.peek(); r == '-' || r == '+' {
+		p.next()
+		p.skipSpace()
+		if r == '-' {
+			sign = "-"
+		}
+		if p.peek() == '$' {
+			// Negative characters, such as -$a
+			p.next()
+			c, err := p.parseChar()
+			if sign == "-" {
+				c = -c
+			}
+			return int64(c), err
+		}
+		if !isDigit(p.peek()) {
+			return nil, p.errorf("expected number after sign, found %s", p.describe())
+		}
+	}
+
+	digits := p.scanDigits(10)
+	if p.peek() == '#' {
+		base, err := strconv.Atoi(digits)
+		if err != nil || base < 2 || base > 36 {
+			return nil, numberError("invalid integer base %s", digits)
+		}
+		p.next()
+		digits = p.scanDigits(base)
+		if digits == "" {
+			return nil, numberError("missing digits after %d#", base)
+		}
+		return parseInteger(sign+digits, base, numberError)
+	}
+
+	// Floats need a digit after the dot, otherwise the dot ends the term
+	if p.peek() == '.' && p.pos+1 < len(p.text) && isDigit(rune(p.text[p.pos+1])) {
+		p.next()
+		fraction := p.scanDigits(10)
+		exponent := ""
+		if r := p.peek(); r == 'e' || r == 'E' {
+			p.next()
+			if r := p.peek(); r == '-' || r == '+' {
+				exponent = string(p.next())
+			}
+			exp := p.scanDigits(10)
+			if exp == "" {
+				return nil, numberError("missing float exponent")
+			}
+			exponent = "e" + exponent + exp
+		}
+		f, err := strconv.ParseFloat(sign+digits+"."+fraction+exponent, 64)
+		if err != nil {
+			return nil, numberError("invalid float: %v", err)
+		}
+		return f, nil
+	}
+	return parseInteger(sign+digits, 10, numberError)
+}
+
+// scanDigits reads the digits of a number in the given base, removing separators.
+func (p *parser) scanDigits(base int) string {
+	var b strings.Builder
+	for {
+		r := p.peek()
+		if r == '_' && b.Len() > 0 {
+			p.next()
+			continue
+		}
+		if d := digitValue(r); d < 0 || d >= base {
+			return b.String()
+		}
+		b.WriteRune(p.next())
+	}
+}
+
+func digitValue(r rune) int {
+	switch {
+	case isDigit(r):
+		return int(r - '0')
+	case r >= 'a' && r <= 'z':
+		return int(r-'a') + 10
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A') + 10
+	}
+	return -1
+}
+
+// parseInteger returns an int64, or a *big.Int when the integer does not fit.
+func parseInteger(s string, base int, numberError func(string, ...interface{}) error) (interface{}, error) {
+	if i, err := strconv.ParseInt(s, base, 64); err == nil {
+		return i, nil
+	}
+	i, ok := new(big.Int).SetString(s, base)
+	if !ok {
+		return nil, numberError("invalid integer %s", s)
+	}
+	return i, nil
+}
@@ -0,0 +1,131 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+func TestParseTerm(t *testing.T) {
+	bigInt, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	var tests = []struct {
+		text     string
+		expected interface{}
+	}{
+		{"42", int64(42)},
+		{"-42.", int64(-42)},
+		{"1_000_000", int64(1000000)},
+		{"16#FF", int64(255)},
+		{"-2#1010", int64(-10)},
+		{"36#zz", int64(1295)},
+		{"123456789012345678901234567890", bigInt},
+		{"$a", int64('a')},
+		{`$\n`, int64('\n')},
+		{`$\x{1F600}`, int64(0x1F600)},
+		{"1.5", 1.5},
+		{"-1.5e-3", -0.0015},
+		{"1.0E10", 1.0e10},
+		{"ok", bertrpc.A("ok")},
+		{"user@localhost", bertrpc.A("user@localhost")},
+		{"été", bertrpc.A("été")},
+		{"'Hello world'", bertrpc.A("Hello world")},
+		{`'it\'s'`, bertrpc.A("it's")},
+		{`"abc"`, bertrpc.List{int64('a'), int64('b'), int64('c')}},
+		{`"a" "b"`, bertrpc.List{int64('a'), int64('b')}},
+		{`""`, bertrpc.List{}},
+		{`"\t\101\^A\s"`, bertrpc.List{int64('\t'), int64('A'), int64(1), int64(' ')}},
+		{"<<>>", []byte{}},
+		{`<<"abc">>`, []byte("abc")},
+		{`<<1, 2, 256, $a, "bc">>`, []byte{1, 2, 0, 'a', 'b', 'c'}},
+		{`<<"été"/utf8>>`, []byte("été")},
+		{`<<"é">>`, []byte{233}},
+		{"{}", bertrpc.Tuple{Elems: []interface{}{}}},
+		{"{ok, 1}", bertrpc.T(bertrpc.A("ok"), int64(1))},
+		{"[]", bertrpc.List{}},
+		{"[a, [b]]", bertrpc.List{bertrpc.A("a"), bertrpc.List{bertrpc.A("b")}}},
+		{"[a | b]", bertrpc.ImproperList{Elems: []interface{}{bertrpc.A("a")}, Tail: bertrpc.A("b")}},
+		{"[a | [b]]", bertrpc.List{bertrpc.A("a"), bertrpc.A("b")}},
+		{"[a | [b | c]]", bertrpc.ImproperList{Elems: []interface{}{bertrpc.A("a"), bertrpc.A("b")}, Tail: bertrpc.A("c")}},
+		{"#{}", bertrpc.Map{}},
+		{`#{a => 1, <<"b">> => [x]}`, bertrpc.Map{
+			{Key: bertrpc.A("a"), Value: int64(1)},
+			{Key: []byte("b"), Value: bertrpc.List{bertrpc.A("x")}},
+		}},
+		{"% comment\n{a, % inline comment\n b}.\n", bertrpc.T(bertrpc.A("a"), bertrpc.A("b"))},
+	}
+
+	for _, tt := range tests {
+		term, err := bertrpc.ParseTerm(tt.text)
+		if err != nil {
+			t.Errorf("cannot parse %s: %s", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(term, tt.expected) {
+			t.Errorf("ParseTerm %s: expected %#v, actual %#v", tt.text, tt.expected, term)
+		}
+	}
+}
+
+func TestParseTermErrors(t *testing.T) {
+	var tests = []struct {
+		text   string
+		line   int
+		column int
+	}{
+		{"", 1, 1},
+		{"{a, b", 1, 6},
+		{"{a b}", 1, 4},
+		{"[a,\n X]", 2, 2},
+		{"{ok,\n  end}", 2, 3},
+		{"'unterminated", 1, 14},
+		{"16#", 1, 1},
+		{"1.5e", 1, 1},
+		{"#{a}", 1, 4},
+		{"<<a>>", 1, 3},
+		{"a b", 1, 3},
+		{"a. b", 1, 4},
+	}
+
+	for _, tt := range tests {
+		_, err := bertrpc.ParseTerm(tt.text)
+		serr, ok := err.(*bertrpc.SyntaxError)
+		if !ok {
+			t.Errorf("parsing %q should return a SyntaxError, got %v", tt.text, err)
+			continue
+		}
+		if serr.Line != tt.line || serr.Column != tt.column {
+			t.Errorf("parsing %q: expected error at %d:%d, got %s", tt.text, tt.line, tt.column, serr)
+		}
+	}
+}
+
+// Formatted terms can be parsed back to the same term.
+func TestParseFormattedTerm(t *testing.T) {
+	term := bertrpc.T(bertrpc.A("Error"), "été", []int{104, 105}, 1.0e20,
+		bertrpc.Map{{Key: bertrpc.A("end"), Value: bertrpc.ImproperList{Elems: []interface{}{1}, Tail: 2}}})
+	data, err := bertrpc.Encode(term)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected interface{}
+	if err := bertrpc.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pretty := range []bool{false, true} {
+		text, err := bertrpc.FormatWithOptions(term, bertrpc.FormatOptions{Pretty: pretty, Width: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := bertrpc.ParseTerm(text)
+		if err != nil {
+			t.Errorf("cannot parse formatted term %s: %s", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("incorrect parsed term: expected %#v, actual %#v", expected, parsed)
+		}
+	}
+}
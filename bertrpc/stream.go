@@ -0,0 +1,67 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// An Encoder writes Erlang terms to an output stream, each term being serialized in
+// External Term Format, with its version tag.
+type Encoder struct {
+	w    io.Writer
+	opts EncodeOptions
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetOptions sets the options used to encode the following terms.
+func (enc *Encoder) SetOptions(opts EncodeOptions) {
+	enc.opts = opts
+}
+
+// Encode writes the ETF encoding of term to the stream.
+// The term is fully encoded before being written, so nothing is written on error.
+func (enc *Encoder) Encode(term interface{}) error {
+	var buf bytes.Buffer
+	if err := encodeTo(term, &buf, enc.opts); err != nil {
+		return err
+	}
+	_, err := enc.w.Write(buf.Bytes())
+	return err
+}
+
+// A Decoder reads consecutive Erlang terms from an input stream.
+type Decoder struct {
+	r    *bufio.Reader
+	opts DecodeOptions
+}
+
+// NewDecoder returns a new decoder that reads from r.
+// The decoder introduces its own buffering and may read data from r beyond the
+// terms requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// SetOptions sets the options used to decode the following terms.
+func (dec *Decoder) SetOptions(opts DecodeOptions) {
+	dec.opts = opts
+}
+
+// Decode reads the next term from the stream and stores it in the value pointed to by term.
+// It returns io.EOF when there are no more terms, and io.ErrUnexpectedEOF when the stream
+// ends in the middle of a term.
+func (dec *Decoder) Decode(term interface{}) error {
+	if err := checkTarget(term); err != nil {
+		return err
+	}
+	d := &decodeState{r: dec.r, opts: dec.opts}
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	return d.decodeData(term)
+}
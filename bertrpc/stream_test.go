@@ -0,0 +1,138 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+func TestEncoderDecoderStream(t *testing.T) {
+	terms := []interface{}{
+		int64(42),
+		[]byte("binary"),
+		bertrpc.T(bertrpc.A("ok"), int64(-1)),
+		// Compressed term in the middle of the stream
+		[]byte(strings.Repeat("compressible ", 100)),
+		bertrpc.List{bertrpc.A("a"), 1.5},
+	}
+
+	var buf bytes.Buffer
+	enc := bertrpc.NewEncoder(&buf)
+	enc.SetOptions(bertrpc.EncodeOptions{CompressionLevel: 6, CompressionThreshold: 64})
+	for _, term := range terms {
+		if err := enc.Encode(term); err != nil {
+			t.Fatalf("cannot encode %v: %s", term, err)
+		}
+	}
+
+	// Network streams can return less data than requested
+	dec := bertrpc.NewDecoder(iotest.OneByteReader(&buf))
+	for _, expected := range terms {
+		var term interface{}
+		if err := dec.Decode(&term); err != nil {
+			t.Fatalf("cannot decode %v: %s", expected, err)
+		}
+		if !reflect.DeepEqual(term, expected) {
+			t.Errorf("incorrect term: expected %#v, actual %#v", expected, term)
+		}
+	}
+	var term interface{}
+	if err := dec.Decode(&term); err != io.EOF {
+		t.Errorf("expected io.EOF at end of stream, got: %v", err)
+	}
+}
+
+func TestDecoderTypedTargets(t *testing.T) {
+	var buf bytes.Buffer
+	enc := bertrpc.NewEncoder(&buf)
+	for _, term := range []interface{}{"john", 1000, []string{"a", "b"}} {
+		if err := enc.Encode(term); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var name string
+	var n int
+	var list []string
+	dec := bertrpc.NewDecoder(iotest.HalfReader(&buf))
+	for _, target := range []interface{}{&name, &n, &list} {
+		if err := dec.Decode(target); err != nil {
+			t.Fatalf("cannot decode to %T: %s", target, err)
+		}
+	}
+	if name != "john" || n != 1000 || !reflect.DeepEqual(list, []string{"a", "b"}) {
+		t.Errorf("incorrect result: %q, %d, %v", name, n, list)
+	}
+}
+
+func TestDecoderUnexpectedEOF(t *testing.T) {
+	// Binary announcing 6 bytes, with only 3 available
+	input := []byte{131, 109, 0, 0, 0, 6, 97, 98, 99}
+	var b []byte
+	if err := bertrpc.NewDecoder(bytes.NewReader(input)).Decode(&b); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+	if err := bertrpc.Decode(bytes.NewReader(input[:2]), &b); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
+
+func TestEncodeStringMode(t *testing.T) {
+	var tests = []struct {
+		str      string
+		expected []byte
+	}{
+		{"", []byte{131, 106}},
+		{"abc", []byte{131, 107, 0, 3, 97, 98, 99}},
+		// Latin-1 characters still fit in STRING_EXT
+		{"été", []byte{131, 107, 0, 3, 233, 116, 233}},
+		{"日本", []byte{131, 108, 0, 0, 0, 2, 98, 0, 0, 101, 229, 98, 0, 0, 103, 44, 106}},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.EncodeWithOptions(tt.str, bertrpc.EncodeOptions{StringMode: bertrpc.StringCharList})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeStringMode %q: expected %v, actual %v", tt.str, tt.expected, data)
+		}
+
+		// CharList values are encoded the same way, whatever the string mode
+		data, err = bertrpc.Encode(bertrpc.CharList{Value: tt.str})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("EncodeCharList %q: expected %v, actual %v", tt.str, tt.expected, data)
+		}
+
+		var s string
+		if err := bertrpc.Decode(bytes.NewReader(data), &s); err != nil || s != tt.str {
+			t.Errorf("cannot decode charlist %q: %q, %v", tt.str, s, err)
+		}
+	}
+}
+
+func TestDecodeBinaryAsString(t *testing.T) {
+	// {<<"john">>, [<<"a">>]}
+	input := []byte{131, 104, 2, 109, 0, 0, 0, 4, 106, 111, 104, 110, 108, 0, 0, 0, 1, 109, 0, 0, 0, 1, 97, 106}
+
+	dec := bertrpc.NewDecoder(bytes.NewReader(input))
+	dec.SetOptions(bertrpc.DecodeOptions{BinaryAsString: true})
+	var term interface{}
+	if err := dec.Decode(&term); err != nil {
+		t.Fatal(err)
+	}
+	expected := bertrpc.T("john", bertrpc.List{"a"})
+	if !reflect.DeepEqual(term, expected) {
+		t.Errorf("incorrect term: expected %#v, actual %#v", expected, term)
+	}
+}
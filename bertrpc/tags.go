@@ -0,0 +1,188 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Go structs are mapped to Erlang tuples by default, each exported field being
+// an element of the tuple, in order.
+// Struct level options are set on a blank field, for example:
+//
+//	type User struct {
+//		_    struct{} `erlang:"record=user"`
+//		Name string
+//	}
+//
+// Supported struct options are:
+//   - record=name: the tuple is an Erlang record. Its first element is the name atom.
+//   - map: the struct is encoded as an Erlang map instead of a tuple.
+//
+// Field tags have the form erlang:"name,option,..." where name is used as map key.
+// Supported field options are:
+//   - atom: the string field is sent as an atom.
+//   - omitempty: the field is not sent in map form when it has its zero value,
+//     or is a zero time.Time.
+//   - timestamp, datetime, unix, unix_ms, unix_us, unix_ns: the time.Time field is
+//     mapped to the given Erlang time representation (see time.go).
+// The "-" name skips the field.
+
+// tagOptions is the string following a comma in a struct field's "erlang" tag,
+// or the empty string.
+type tagOptions string
+
+// parseTag splits a struct field's erlang tag into its name and
+// comma-separated options.
+func parseTag(tag string) (string, tagOptions) {
+	if idx := strings.Index(tag, ","); idx != -1 {
+		return tag[:idx], tagOptions(tag[idx+1:])
+	}
+	return tag, tagOptions("")
+}
+
+// Contains reports whether a comma-separated list of options
+// contains a particular option.
+func (o tagOptions) Contains(option string) bool {
+	_, ok := o.Lookup(option)
+	return ok
+}
+
+// Lookup returns the value of an option, set as option=value.
+func (o tagOptions) Lookup(option string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == option {
+			return "", true
+		}
+		if strings.HasPrefix(s, option+"=") {
+			return s[len(option)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
+
+// structInfo describes how a struct type is mapped to an Erlang term.
+type structInfo struct {
+	// record is the name of the record, if the struct is an Erlang record.
+	record string
+	// asMap is set if the struct is encoded as an Erlang map.
+	asMap  bool
+	fields []fieldInfo
+}
+
+// fieldInfo describes a struct field mapped to an Erlang tuple element or map entry.
+type fieldInfo struct {
+	index int
+	name  string
+	// tagged is set when the name is set in the erlang tag.
+	tagged    bool
+	atom      bool
+	omitEmpty bool
+	// time is the representation of a time.Time field.
+	time string
+}
+
+// structInfoCache maps struct types to their structInfo, as tags are parsed
+// for each encoded or decoded struct value.
+var structInfoCache sync.Map // map[reflect.Type]structInfo
+
+func getStructInfo(t reflect.Type) structInfo {
+	if info, ok := structInfoCache.Load(t); ok {
+		return info.(structInfo)
+	}
+	info, _ := structInfoCache.LoadOrStore(t, buildStructInfo(t))
+	return info.(structInfo)
+}
+
+func buildStructInfo(t reflect.Type) structInfo {
+	var info structInfo
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("erlang")
+
+		// Struct options
+		if field.Name == "_" {
+			opts := tagOptions(tag)
+			if record, ok := opts.Lookup("record"); ok {
+				info.record = record
+			}
+			info.asMap = info.asMap || opts.Contains("map")
+			continue
+		}
+		// Skip unexported fields
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, opts := parseTag(tag)
+		if name == "-" {
+			continue
+		}
+		tagged := name != ""
+		if !tagged {
+			name = field.Name
+		}
+		info.fields = append(info.fields, fieldInfo{
+			index:     i,
+			name:      name,
+			tagged:    tagged,
+			atom:      opts.Contains("atom"),
+			omitEmpty: opts.Contains("omitempty"),
+			time:      timeOption(opts),
+		})
+	}
+	return info
+}
+
+// isTaggedStruct checks if the struct represents a set of tagged values, such
+// as ok | {error, Reason}. The first field must be a string tagged as erlang:"tag".
+// It receives the tag atom, while the other fields receive the values following the tag,
+// depending on the tag value: a field tagged as erlang:"tag:error" receives Reason.
+func isTaggedStruct(t reflect.Type) bool {
+	if t.NumField() == 0 {
+		return false
+	}
+	field1 := t.Field(0)
+	name, _ := parseTag(field1.Tag.Get("erlang"))
+	return name == "tag" && field1.Type.Kind() == reflect.String
+}
+
+// tagFields returns the fields of a tagged struct used for the given tag, in position order.
+func tagFields(info structInfo, tag string) []fieldInfo {
+	var fields []fieldInfo
+	for _, f := range info.fields {
+		if f.name == "tag:"+tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldByKey returns the struct field matching an Erlang map key, and false
+// if there is no such field.
+// The key is matched against the name set in the erlang tag, or against the field
+// name if there is no tag. Tag names must match exactly, while field name matching
+// is case insensitive, with a preference
+// for exact matches.
+func fieldByKey(t reflect.Type, key string) (fieldInfo, bool) {
+	fold := -1
+	fields := getStructInfo(t).fields
+	for i, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+		if fold == -1 && !f.tagged && strings.EqualFold(f.name, key) {
+			fold = i
+		}
+	}
+	if fold == -1 {
+		return fieldInfo{}, false
+	}
+	return fields[fold], true
+}
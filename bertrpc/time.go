@@ -0,0 +1,190 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Erlang has no time type. time.Time struct fields are mapped to one of the Erlang
+// time representations, selected by a field option:
+//   - timestamp: {MegaSecs, Secs, MicroSecs}, as returned by erlang:timestamp().
+//   - datetime: {{Year, Month, Day}, {Hour, Minute, Second}}, as used by the calendar
+//     module, in UTC. Fractions of seconds are truncated.
+//   - unix, unix_ms, unix_us, unix_ns: integer system time in seconds, milliseconds,
+//     microseconds or nanoseconds, as returned by erlang:system_time/1.
+// Times are decoded in UTC. Fields can also be *time.Time, to map the nil atom to nil.
+//
+// time.Duration values are mapped to integer milliseconds, as used by Erlang timeouts.
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// unixUnits is the number of units per second of the integer time options.
+var unixUnits = map[string]int64{
+	"unix":    1,
+	"unix_ms": 1e3,
+	"unix_us": 1e6,
+	"unix_ns": 1e9,
+}
+
+// timeOption returns the time representation set in field options, or "".
+func timeOption(opts tagOptions) string {
+	for _, option := range []string{"timestamp", "datetime", "unix", "unix_ms", "unix_us", "unix_ns"} {
+		if opts.Contains(option) {
+			return option
+		}
+	}
+	return ""
+}
+
+// timeTerm returns the generic term representing t, in the given representation.
+func timeTerm(t time.Time, repr string) (interface{}, error) {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch repr {
+	case "timestamp":
+		mega := sec / 1e6
+		if sec%1e6 < 0 {
+			mega--
+		}
+		return T(mega, sec-mega*1e6, nsec/1e3), nil
+	case "datetime":
+		t = t.UTC()
+		return T(
+			T(int64(t.Year()), int64(t.Month()), int64(t.Day())),
+			T(int64(t.Hour()), int64(t.Minute()), int64(t.Second())),
+		), nil
+	}
+
+	n := unixUnits[repr]
+	if sec > math.MaxInt64/n-1 || sec < math.MinInt64/n {
+		return nil, fmt.Errorf("cannot encode time %s as %s: overflow", t, repr)
+	}
+	return sec*n + nsec/(1e9/n), nil
+}
+
+// decodeTimeTo decodes a time in the given representation to a time.Time or
+// *time.Time value.
+func (d *decodeState) decodeTimeTo(val reflect.Value, repr string) error {
+	if val.Kind() == reflect.Ptr {
+		isNil, err := d.decodeNilAtom()
+		if err != nil || isNil {
+			if isNil {
+				val.Set(reflect.Zero(val.Type()))
+			}
+			return err
+		}
+		if val.IsNil() {
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		val = val.Elem()
+	}
+
+	t, err := d.decodeTime(repr)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s time: %v", repr, err)
+	}
+	val.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func (d *decodeState) decodeTime(repr string) (time.Time, error) {
+	switch repr {
+	case "timestamp":
+		var ts [3]int64
+		if err := d.decodeIntTuple(ts[:]); err != nil {
+			return time.Time{}, err
+		}
+		mega, sec, micro := ts[0], ts[1], ts[2]
+		if mega > math.MaxInt64/int64(1e6) || mega < math.MinInt64/int64(1e6) {
+			return time.Time{}, &RangeError{Value: strconv.FormatInt(mega, 10), Type: timeType}
+		}
+		return time.Unix(mega*1e6+sec, micro*1e3).UTC(), nil
+	case "datetime":
+		return d.decodeDatetime()
+	}
+
+	n := unixUnits[repr]
+	i, err := d.decodeInt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec := i / n
+	if i%n < 0 {
+		sec--
+	}
+	return time.Unix(sec, (i-sec*n)*(1e9/n)).UTC(), nil
+}
+
+// decodeDatetime decodes a calendar datetime, checking that it is a valid date and time.
+func (d *decodeState) decodeDatetime() (time.Time, error) {
+	if err := d.readTimeTuple(2); err != nil {
+		return time.Time{}, err
+	}
+	var date, clock [3]int64
+	if err := d.decodeIntTuple(date[:]); err != nil {
+		return time.Time{}, err
+	}
+	if err := d.decodeIntTuple(clock[:]); err != nil {
+		return time.Time{}, err
+	}
+
+	t := time.Date(int(date[0]), time.Month(date[1]), int(date[2]),
+		int(clock[0]), int(clock[1]), int(clock[2]), 0, time.UTC)
+	if int64(t.Year()) != date[0] || int64(t.Month()) != date[1] || int64(t.Day()) != date[2] ||
+		int64(t.Hour()) != clock[0] || int64(t.Minute()) != clock[1] || int64(t.Second()) != clock[2] {
+		return time.Time{}, fmt.Errorf("invalid datetime {{%d,%d,%d},{%d,%d,%d}}",
+			date[0], date[1], date[2], clock[0], clock[1], clock[2])
+	}
+	return t, nil
+}
+
+// decodeIntTuple decodes a tuple of integers, of the length of ints.
+func (d *decodeState) decodeIntTuple(ints []int64) error {
+	if err := d.readTimeTuple(len(ints)); err != nil {
+		return err
+	}
+	for i := range ints {
+		var err error
+		if ints[i], err = d.decodeInt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTimeTuple reads the header of a tuple, which must have n elements.
+func (d *decodeState) readTimeTuple(n int) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagSmallTuple && tag != TagLargeTuple {
+		return fmt.Errorf("expected a tuple, got %s", tagName(tag))
+	}
+	length, err := d.readTupleLength(tag)
+	if err != nil {
+		return err
+	}
+	if length != n {
+		return fmt.Errorf("expected a tuple of length %d, got %d", n, length)
+	}
+	return nil
+}
+
+// decodeDuration decodes integer milliseconds to a time.Duration value.
+func (d *decodeState) decodeDuration(val reflect.Value) error {
+	ms, err := d.decodeInt()
+	if err != nil {
+		return err
+	}
+	if ms > math.MaxInt64/int64(time.Millisecond) || ms < math.MinInt64/int64(time.Millisecond) {
+		return &RangeError{Value: strconv.FormatInt(ms, 10), Type: val.Type()}
+	}
+	val.SetInt(ms * int64(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,258 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+type session struct {
+	Started  time.Time  `erlang:"started,timestamp"`
+	Login    time.Time  `erlang:",datetime"`
+	Seen     time.Time  `erlang:",unix_ms"`
+	Expires  *time.Time `erlang:",unix"`
+	Timeout  time.Duration
+	Accessed time.Time `erlang:",unix_us"`
+	Updated  time.Time `erlang:",unix_ns"`
+}
+
+func TestEncodeTime(t *testing.T) {
+	// 2019-08-05T10:13:20.123456789Z
+	ts := time.Unix(1565000000, 123456789).UTC()
+	s := session{Started: ts, Login: ts, Seen: ts, Timeout: 5 * time.Second, Accessed: ts, Updated: ts}
+	data, err := bertrpc.Encode(s)
+	if err != nil {
+		t.Errorf("cannot encode time fields: %s", err)
+		return
+	}
+
+	var term interface{}
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &term); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	want := bertrpc.T(
+		bertrpc.T(int64(1565), int64(0), int64(123456)),
+		bertrpc.T(bertrpc.T(int64(2019), int64(8), int64(5)), bertrpc.T(int64(10), int64(13), int64(20))),
+		int64(1565000000123),
+		bertrpc.A("undefined"),
+		int64(5000),
+		int64(1565000000123456),
+		int64(1565000000123456789),
+	)
+	if !reflect.DeepEqual(term, want) {
+		t.Errorf("incorrect encoded term: %v. expected: %v", term, want)
+	}
+}
+
+func TestDecodeTime(t *testing.T) {
+	ts := time.Unix(1565000000, 123456789).UTC()
+	moon := time.Date(1969, 7, 20, 20, 17, 40, 500000000, time.UTC)
+	tests := []struct {
+		name  string
+		input session
+		want  session
+	}{
+		{
+			name:  "truncated to each precision",
+			input: session{Started: ts, Login: ts, Seen: ts, Expires: &ts, Timeout: 1500 * time.Millisecond, Accessed: ts, Updated: ts},
+			want: session{
+				Started:  ts.Truncate(time.Microsecond),
+				Login:    ts.Truncate(time.Second),
+				Seen:     ts.Truncate(time.Millisecond),
+				Expires:  timePtr(ts.Truncate(time.Second)),
+				Timeout:  1500 * time.Millisecond,
+				Accessed: ts.Truncate(time.Microsecond),
+				Updated:  ts,
+			},
+		},
+		{
+			name:  "before 1970",
+			input: session{Started: moon, Login: moon, Seen: moon, Accessed: moon, Updated: moon},
+			want:  session{Started: moon, Login: moon.Truncate(time.Second), Seen: moon, Accessed: moon, Updated: moon},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			data, err := bertrpc.Encode(tc.input)
+			if err != nil {
+				st.Errorf("cannot encode time fields: %s", err)
+				return
+			}
+			var s session
+			if err := bertrpc.Decode(bytes.NewBuffer(data), &s); err != nil {
+				st.Errorf("cannot decode Erlang term: %s", err)
+				return
+			}
+			if !reflect.DeepEqual(s, tc.want) {
+				st.Errorf("incorrect decoded value: %+v. expected: %+v", s, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeInMap(t *testing.T) {
+	type event struct {
+		_    struct{}  `erlang:"map"`
+		Name string    `erlang:"name"`
+		At   time.Time `erlang:"at,datetime"`
+	}
+	at := time.Date(2020, 2, 29, 23, 59, 59, 0, time.UTC)
+	data, err := bertrpc.Encode(event{Name: "leap", At: at})
+	if err != nil {
+		t.Errorf("cannot encode time field: %s", err)
+		return
+	}
+	var e event
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &e); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if e.Name != "leap" || !e.At.Equal(at) {
+		t.Errorf("incorrect decoded value: %+v", e)
+	}
+}
+
+func TestOmitEmptyTime(t *testing.T) {
+	type event struct {
+		_       struct{}   `erlang:"map"`
+		Name    string     `erlang:"name"`
+		At      time.Time  `erlang:"at,datetime,omitempty"`
+		Expires *time.Time `erlang:"expires,unix,omitempty"`
+	}
+	at := time.Date(2020, 2, 29, 23, 59, 59, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input event
+		want  bertrpc.Map
+	}{
+		{name: "zero", input: event{Name: "none"},
+			want: bertrpc.Map{{Key: bertrpc.A("name"), Value: "none"}}},
+		{name: "set", input: event{Name: "leap", At: at, Expires: &at},
+			want: bertrpc.Map{
+				{Key: bertrpc.A("name"), Value: "leap"},
+				{Key: bertrpc.A("at"), Value: bertrpc.T(bertrpc.T(2020, 2, 29), bertrpc.T(23, 59, 59))},
+				{Key: bertrpc.A("expires"), Value: at.Unix()},
+			}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			data, err := bertrpc.Encode(tc.input)
+			if err != nil {
+				st.Errorf("cannot encode time fields: %s", err)
+				return
+			}
+			expected, err := bertrpc.Encode(tc.want)
+			if err != nil {
+				st.Fatal(err)
+			}
+			if !bytes.Equal(data, expected) {
+				st.Errorf("incorrect encoding: %v (!= %v)", data, expected)
+			}
+		})
+	}
+}
+
+func TestDecodeTimeErrors(t *testing.T) {
+	type datetime struct {
+		At time.Time `erlang:",datetime"`
+	}
+	type timestamp struct {
+		At time.Time `erlang:",timestamp"`
+	}
+	type wrongType struct {
+		At string `erlang:",unix_ms"`
+	}
+	type untagged struct {
+		At time.Time
+	}
+	dt := func(y, m, d, h, mi, s int64) bertrpc.Tuple {
+		return bertrpc.T(bertrpc.T(bertrpc.T(y, m, d), bertrpc.T(h, mi, s)))
+	}
+	tests := []struct {
+		name   string
+		input  interface{}
+		target interface{}
+		err    string
+	}{
+		{name: "invalid date", input: dt(2019, 2, 29, 0, 0, 0), target: &datetime{}, err: "invalid datetime {{2019,2,29},{0,0,0}}"},
+		{name: "invalid time", input: dt(2019, 1, 1, 24, 0, 0), target: &datetime{}, err: "invalid datetime {{2019,1,1},{24,0,0}}"},
+		{name: "short datetime", input: bertrpc.T(bertrpc.T(bertrpc.T(int64(2019), int64(1), int64(1)))), target: &datetime{}, err: "expected a tuple of length 2, got 1"},
+		{name: "not a tuple", input: bertrpc.T(int64(42)), target: &timestamp{}, err: "expected a tuple, got SmallInteger"},
+		{name: "short timestamp", input: bertrpc.T(bertrpc.T(int64(1565), int64(0))), target: &timestamp{}, err: "expected a tuple of length 3, got 2"},
+		{name: "wrong field type", input: bertrpc.T(int64(42)), target: &wrongType{}, err: "unix_ms option cannot be used on field At of type string"},
+		{name: "no time option", input: bertrpc.T(int64(42)), target: &untagged{}, err: "cannot decode time.Time without a time representation option"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			data, err := bertrpc.Encode(tc.input)
+			if err != nil {
+				st.Errorf("cannot encode %v: %s", tc.input, err)
+				return
+			}
+			err = bertrpc.Decode(bytes.NewBuffer(data), tc.target)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				st.Errorf("unexpected error: %v. expected: %s", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestEncodeTimeErrors(t *testing.T) {
+	if _, err := bertrpc.Encode(time.Now()); err == nil {
+		t.Errorf("encoding time.Time without a time option should fail")
+	}
+	type nanos struct {
+		At time.Time `erlang:",unix_ns"`
+	}
+	if _, err := bertrpc.Encode(nanos{}); err == nil {
+		t.Errorf("encoding year 1 as nanoseconds should overflow")
+	}
+	type wrongType struct {
+		At int64 `erlang:",timestamp"`
+	}
+	if _, err := bertrpc.Encode(wrongType{}); err == nil {
+		t.Errorf("encoding a timestamp field of type int64 should fail")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	data, err := bertrpc.Encode([]time.Duration{time.Minute, 1500 * time.Microsecond, -time.Second})
+	if err != nil {
+		t.Errorf("cannot encode durations: %s", err)
+		return
+	}
+	var ms []int64
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &ms); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if want := []int64{60000, 1, -1000}; !reflect.DeepEqual(ms, want) {
+		t.Errorf("incorrect encoded durations: %v. expected: %v", ms, want)
+	}
+
+	var durations []time.Duration
+	if err := bertrpc.Decode(bytes.NewBuffer(data), &durations); err != nil {
+		t.Errorf("cannot decode Erlang term: %s", err)
+		return
+	}
+	if want := []time.Duration{time.Minute, time.Millisecond, -time.Second}; !reflect.DeepEqual(durations, want) {
+		t.Errorf("incorrect decoded durations: %v. expected: %v", durations, want)
+	}
+
+	// Durations are limited to about 292 years
+	data, _ = bertrpc.Encode(int64(1) << 50)
+	var d time.Duration
+	checkRangeError(t, bertrpc.Decode(bytes.NewBuffer(data), &d), "erlang number 1125899906842624 overflows time.Duration")
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,285 @@
+package bertrpc // import "gosrc.io/erlang/bertrpc"
+
+import (
+	"fmt"
+)
+
+// A Visitor receives the parts of a term walked by Walk, in the order of their
+// encoding. It gives access to the details of the external term format that are
+// lost when decoding terms, such as the tags and the padding of big integers.
+type Visitor interface {
+	// BeginTerm is called with the tag of each term, before its parts and the
+	// terms nested in it.
+	BeginTerm(tag byte) error
+	// Uint is called with each integer field of a term, and its size in bytes.
+	// Integer fields are the lengths of terms and their element counts, the value of
+	// SMALL_INTEGER_EXT and INTEGER_EXT, the bits of NEW_FLOAT_EXT, the sign of big
+	// integers, the unused bits of BIT_BINARY_EXT, and the IDs and creation of pids,
+	// ports and references.
+	Uint(u uint64, size int) error
+	// Bytes is called with the content of atoms, strings, binaries, bitstrings, big
+	// integers, FLOAT_EXT and NEW_FUN_EXT, after their length. The data is a view of
+	// the input, and must be copied to be retained.
+	Bytes(data []byte) error
+	// EndTerm is called after the parts of a term.
+	EndTerm(tag byte) error
+}
+
+// Walk walks the term encoded in data, calling v for each of its parts. Compressed
+// terms are inflated. The data must contain exactly one term, which is checked against
+// the limits of opts, as if it was decoded.
+func Walk(data []byte, v Visitor, opts DecodeOptions) error {
+	d := &decodeState{data: data, opts: opts}
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	if err := d.walkTerm(v); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return fmt.Errorf("%d bytes of trailing data after term", len(d.data)-d.off)
+	}
+	return nil
+}
+
+// skipVisitor ignores the parts of the walked terms.
+type skipVisitor struct{}
+
+func (skipVisitor) BeginTerm(byte) error   { return nil }
+func (skipVisitor) Uint(uint64, int) error { return nil }
+func (skipVisitor) Bytes([]byte) error     { return nil }
+func (skipVisitor) EndTerm(byte) error     { return nil }
+
+// walkTerm reads the next term, calling v for each of its parts.
+func (d *decodeState) walkTerm(v Visitor) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	return d.walkBody(tag, v)
+}
+
+// walkAtom walks the node of an identifier, or the module and function of an export.
+func (d *decodeState) walkAtom(v Visitor) error {
+	tag, err := d.readTag()
+	if err != nil {
+		return err
+	}
+	if tag != TagDeprecatedAtom && tag != TagAtomUTF8 && tag != TagSmallAtomUTF8 {
+		return fmt.Errorf("cannot decode type %d as atom", tag)
+	}
+	return d.walkBody(tag, v)
+}
+
+// walkBody walks a term whose tag has already been read.
+func (d *decodeState) walkBody(tag int, v Visitor) error {
+	if err := v.BeginTerm(byte(tag)); err != nil {
+		return err
+	}
+	if err := d.walkContent(tag, v); err != nil {
+		return err
+	}
+	return v.EndTerm(byte(tag))
+}
+
+func (d *decodeState) walkContent(tag int, v Visitor) error {
+	switch tag {
+	case TagSmallInteger:
+		_, err := d.walkUint(v, 1)
+		return err
+	case TagInteger:
+		_, err := d.walkUint(v, 4)
+		return err
+	case TagNewFloat:
+		_, err := d.walkUint(v, 8)
+		return err
+	case TagFloat:
+		return d.walkBytes(v, 31)
+
+	case TagSmallBig, TagLargeBig:
+		size := 1
+		if tag == TagLargeBig {
+			size = 4
+		}
+		n, err := d.walkUint(v, size)
+		if err != nil {
+			return err
+		}
+		// Sign
+		if _, err := d.walkUint(v, 1); err != nil {
+			return err
+		}
+		return d.walkBytes(v, int(n))
+
+	case TagSmallAtomUTF8:
+		n, err := d.walkUint(v, 1)
+		if err != nil {
+			return err
+		}
+		return d.walkBytes(v, int(n))
+	case TagDeprecatedAtom, TagAtomUTF8, TagString:
+		n, err := d.walkUint(v, 2)
+		if err != nil {
+			return err
+		}
+		return d.walkBytes(v, int(n))
+	case TagBinary, TagBitBinary:
+		n, err := d.walkUint(v, 4)
+		if err != nil {
+			return err
+		}
+		if err := d.checkBinarySize(uint32(n)); err != nil {
+			return err
+		}
+		if tag == TagBitBinary {
+			// Number of bits used in the last byte
+			if _, err := d.walkUint(v, 1); err != nil {
+				return err
+			}
+		}
+		return d.walkBytes(v, int(n))
+
+	case TagNewPid, TagPid:
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		return d.walkUints(v, 4, 4, creationSize(tag == TagPid))
+	case TagNewPort, TagPort:
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		return d.walkUints(v, 4, creationSize(tag == TagPort))
+	case TagV4Port:
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		return d.walkUints(v, 8, 4)
+	case TagNewerReference, TagNewReference:
+		count, err := d.walkUint(v, 2)
+		if err != nil {
+			return err
+		}
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		if _, err := d.walkUint(v, creationSize(tag == TagNewReference)); err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := d.walkUint(v, 4); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TagReference:
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		return d.walkUints(v, 4, 1)
+
+	case TagExport:
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		if err := d.walkAtom(v); err != nil {
+			return err
+		}
+		arityTag, err := d.readTag()
+		if err != nil {
+			return err
+		}
+		if arityTag != TagSmallInteger {
+			return fmt.Errorf("invalid export arity: %s", tagName(arityTag))
+		}
+		return d.walkBody(arityTag, v)
+	case TagNewFun:
+		size, err := d.walkUint(v, 4)
+		if err != nil {
+			return err
+		}
+		// Size includes the size field itself
+		if size < 4 {
+			return fmt.Errorf("invalid fun size: %d", size)
+		}
+		return d.walkBytes(v, int(size)-4)
+
+	case TagNil:
+		return nil
+
+	case TagSmallTuple, TagLargeTuple, TagList, TagMap:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+
+		size := 4
+		if tag == TagSmallTuple {
+			size = 1
+		}
+		n, err := d.walkUint(v, size)
+		if err != nil {
+			return err
+		}
+		if size == 4 {
+			if err := d.checkElements(uint32(n)); err != nil {
+				return err
+			}
+		}
+		count := int(n)
+		switch tag {
+		case TagList:
+			// Elements and tail
+			count++
+		case TagMap:
+			// Keys and values
+			count *= 2
+		}
+		for i := 0; i < count; i++ {
+			if err := d.walkTerm(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("cannot walk term %s", tagName(tag))
+}
+
+// walkUint reads a big endian integer field of the given size in bytes.
+func (d *decodeState) walkUint(v Visitor, size int) (uint64, error) {
+	if err := d.read(d.scratch[:size]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	var u uint64
+	for _, b := range d.scratch[:size] {
+		u = u<<8 | uint64(b)
+	}
+	return u, v.Uint(u, size)
+}
+
+// walkUints reads consecutive integer fields of the given sizes.
+func (d *decodeState) walkUints(v Visitor, sizes ...int) error {
+	for _, size := range sizes {
+		if _, err := d.walkUint(v, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkBytes reads n bytes of content.
+func (d *decodeState) walkBytes(v Visitor, n int) error {
+	data, err := d.view(n)
+	if err != nil {
+		return err
+	}
+	return v.Bytes(data)
+}
+
+// creationSize returns the size of the creation field of an identifier.
+func creationSize(legacy bool) int {
+	if legacy {
+		return 1
+	}
+	return 4
+}
@@ -0,0 +1,77 @@
+package bertrpc_test // import "gosrc.io/erlang/bertrpc_test"
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+// partsVisitor records the parts of the walked terms.
+type partsVisitor struct {
+	parts []string
+}
+
+func (v *partsVisitor) BeginTerm(tag byte) error {
+	v.parts = append(v.parts, fmt.Sprintf("begin %d", tag))
+	return nil
+}
+
+func (v *partsVisitor) Uint(u uint64, size int) error {
+	v.parts = append(v.parts, fmt.Sprintf("uint%d %d", 8*size, u))
+	return nil
+}
+
+func (v *partsVisitor) Bytes(data []byte) error {
+	v.parts = append(v.parts, fmt.Sprintf("bytes %q", data))
+	return nil
+}
+
+func (v *partsVisitor) EndTerm(tag byte) error {
+	v.parts = append(v.parts, fmt.Sprintf("end %d", tag))
+	return nil
+}
+
+func TestWalk(t *testing.T) {
+	// [{ok, <<"a">>} | -256], with a big integer padded with zeros
+	data := []byte{131, 108, 0, 0, 0, 1, 104, 2, 119, 2, 'o', 'k', 109, 0, 0, 0, 1, 'a', 110, 2, 1, 0, 1}
+	var v partsVisitor
+	if err := bertrpc.Walk(data, &v, bertrpc.DecodeOptions{}); err != nil {
+		t.Fatalf("cannot walk term: %v", err)
+	}
+	want := []string{
+		"begin 108", "uint32 1",
+		"begin 104", "uint8 2",
+		"begin 119", "uint8 2", `bytes "ok"`, "end 119",
+		"begin 109", "uint32 1", `bytes "a"`, "end 109",
+		"end 104",
+		"begin 110", "uint8 2", "uint8 1", `bytes "\x00\x01"`, "end 110",
+		"end 108",
+	}
+	if !reflect.DeepEqual(v.parts, want) {
+		t.Errorf("incorrect parts: %q. expected: %q", v.parts, want)
+	}
+}
+
+func TestWalkErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		opts  bertrpc.DecodeOptions
+	}{
+		{name: "truncated", input: []byte{131, 109, 0, 0, 0, 2, 'a'}},
+		{name: "trailing data", input: []byte{131, 106, 106}},
+		{name: "unknown tag", input: []byte{131, 1}},
+		{name: "pid node", input: []byte{131, 88, 97, 1, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		{name: "limits", input: nestedLists(3), opts: bertrpc.DecodeOptions{Limits: bertrpc.DecodeLimits{MaxDepth: 2}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			if err := bertrpc.Walk(tc.input, &partsVisitor{}, tc.opts); err == nil {
+				st.Errorf("walking %v should fail", tc.input)
+			}
+		})
+	}
+}
@@ -0,0 +1,582 @@
+// Package etfjson converts Erlang terms, in External Term Format, to JSON and back.
+//
+// By default, terms are mapped to JSON as follows:
+//
+//	integers and floats   numbers, floats always having a fraction or an exponent
+//	true and false atoms  true and false
+//	null atom             null
+//	other atoms           strings, or {"$atom": "name"} with AtomObject
+//	binaries              UTF-8 strings, or {"$binary": "base64"} when they are not valid UTF-8;
+//	                      base64 strings with BinaryBase64
+//	bitstrings            {"$bitstring": "base64", "bits": n}, n being the number of bits of the last byte
+//	tuples                arrays, or {"$tuple": [...]} with TupleObject
+//	lists                 arrays; proplists are objects with Proplists
+//	improper lists        {"$improper": [...], "tail": term}
+//	maps                  objects, or {"$map": [[key, value], ...]} when keys are not text
+//	pids, ports, refs     {"$etf": "base64"}, holding the ETF encoding of the term
+//	and funs
+//
+// Converting JSON to Erlang terms reverses the mapping: strings become binaries,
+// arrays become lists and objects become maps, or proplists with Proplists. Object keys
+// are always converted to binaries. Objects with one of the keys starting with $ listed
+// above are converted to the corresponding term.
+//
+// Only terms without ambiguities survive a round trip through JSON with this mapping.
+// The lossless mode uses a different representation, which converts back exactly to the
+// original encoding: see ToJSON.
+package etfjson // import "gosrc.io/erlang/etfjson"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+// AtomMode selects the JSON representation of atoms, other than true, false and null.
+type AtomMode int
+
+const (
+	// AtomString converts atoms to strings. This is the default. Strings are converted
+	// back to binaries.
+	AtomString AtomMode = iota
+	// AtomObject converts atoms to {"$atom": "name"} objects, which are converted back to atoms.
+	AtomObject
+)
+
+// TupleMode selects the JSON representation of tuples.
+type TupleMode int
+
+const (
+	// TupleArray converts tuples to arrays. This is the default. Arrays are converted
+	// back to lists.
+	TupleArray TupleMode = iota
+	// TupleObject converts tuples to {"$tuple": [...]} objects, which are converted back to tuples.
+	TupleObject
+)
+
+// BinaryMode selects the JSON representation of binaries.
+type BinaryMode int
+
+const (
+	// BinaryUTF8 converts binaries holding valid UTF-8 text to strings, and other binaries
+	// to {"$binary": "base64"} objects. This is the default.
+	BinaryUTF8 BinaryMode = iota
+	// BinaryBase64 converts all binaries to base64 strings. Strings are decoded from
+	// base64 when converted back to binaries.
+	BinaryBase64
+)
+
+// Options controls the mapping between Erlang terms and JSON.
+// The zero value uses the default mapping.
+type Options struct {
+	Atoms    AtomMode
+	Tuples   TupleMode
+	Binaries BinaryMode
+	// Proplists converts lists of 2-tuples with atom or binary keys to objects, and
+	// objects back to lists of 2-tuples with binary keys.
+	Proplists bool
+	// Lossless uses the lossless representation of terms. Other mapping options are ignored.
+	Lossless bool
+	// Limits bounds the resources used to decode the Erlang terms.
+	Limits bertrpc.DecodeLimits
+}
+
+// ToJSON converts an Erlang term, encoded in External Term Format, to JSON.
+//
+// In lossless mode, each term is converted to an array holding the name of its ETF tag,
+// as in the Erlang documentation without the _EXT suffix, followed by its content:
+//
+//	["small_integer", 42]
+//	["small_atom_utf8", "ok"]
+//	["small_tuple", ["small_atom_utf8", "ok"], ["binary", "aGVsbG8="]]
+//	["list", [["small_integer", 1]], ["nil"]]
+//
+// Converting this JSON back with FromJSON gives the original encoding. Compressed terms
+// are represented as ["compressed", term]; their content is preserved, but the compressed
+// data itself can differ.
+func ToJSON(data []byte, opts Options) ([]byte, error) {
+	if opts.Lossless {
+		return losslessToJSON(data, opts)
+	}
+
+	var term interface{}
+	if err := bertrpc.UnmarshalWithOptions(data, &term, bertrpc.DecodeOptions{Limits: opts.Limits}); err != nil {
+		return nil, err
+	}
+	c := converter{opts: opts}
+	if err := c.writeTerm(term); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// FromJSON converts JSON to an Erlang term, encoded in External Term Format.
+// In lossless mode, the JSON must use the representation returned by ToJSON in that mode.
+func FromJSON(data []byte, opts Options) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if opts.Lossless {
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("unexpected data after JSON value")
+		}
+		return losslessFromJSON(value)
+	}
+
+	value, err := readValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	c := converter{opts: opts}
+	term, err := c.term(value)
+	if err != nil {
+		return nil, err
+	}
+	return bertrpc.Encode(term)
+}
+
+// ============================================================================
+// Erlang to JSON
+
+// converter holds the mapping options and the JSON being written.
+type converter struct {
+	opts Options
+	buf  bytes.Buffer
+}
+
+// writeTerm writes a generic term, as decoded by bertrpc to an empty interface.
+func (c *converter) writeTerm(term interface{}) error {
+	switch t := term.(type) {
+	case int64:
+		c.buf.WriteString(strconv.FormatInt(t, 10))
+	case *big.Int:
+		c.buf.WriteString(t.String())
+	case float64:
+		return writeFloat(&c.buf, t)
+	case bertrpc.String:
+		return c.writeAtom(t.Value)
+	case []byte:
+		c.writeBinary(t)
+	case bertrpc.BitString:
+		c.buf.WriteString(`{"$bitstring":`)
+		writeString(&c.buf, base64.StdEncoding.EncodeToString(t.Bytes))
+		fmt.Fprintf(&c.buf, `,"bits":%d}`, t.Bits)
+	case bertrpc.Tuple:
+		if c.opts.Tuples == TupleObject {
+			c.buf.WriteString(`{"$tuple":`)
+			defer c.buf.WriteString("}")
+		}
+		return c.writeArray(t.Elems)
+	case bertrpc.List:
+		if keys, ok := c.proplistKeys(t); ok {
+			return c.writeObject(keys, func(i int) interface{} { return t[i].(bertrpc.Tuple).Elems[1] })
+		}
+		return c.writeArray(t)
+	case bertrpc.ImproperList:
+		c.buf.WriteString(`{"$improper":`)
+		if err := c.writeArray(t.Elems); err != nil {
+			return err
+		}
+		c.buf.WriteString(`,"tail":`)
+		if err := c.writeTerm(t.Tail); err != nil {
+			return err
+		}
+		c.buf.WriteString("}")
+	case bertrpc.Map:
+		return c.writeMap(t)
+	case bertrpc.Pid, bertrpc.Port, bertrpc.Ref, bertrpc.Export, bertrpc.Fun:
+		data, err := bertrpc.Encode(t)
+		if err != nil {
+			return err
+		}
+		c.buf.WriteString(`{"$etf":`)
+		writeString(&c.buf, base64.StdEncoding.EncodeToString(data))
+		c.buf.WriteString("}")
+	default:
+		return fmt.Errorf("cannot convert %T to JSON", term)
+	}
+	return nil
+}
+
+func (c *converter) writeAtom(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("atom %q is not valid UTF-8", name)
+	}
+	switch {
+	case name == "true" || name == "false" || name == "null":
+		c.buf.WriteString(name)
+	case c.opts.Atoms == AtomObject:
+		c.buf.WriteString(`{"$atom":`)
+		writeString(&c.buf, name)
+		c.buf.WriteString("}")
+	default:
+		writeString(&c.buf, name)
+	}
+	return nil
+}
+
+func (c *converter) writeBinary(data []byte) {
+	switch {
+	case c.opts.Binaries == BinaryBase64:
+		writeString(&c.buf, base64.StdEncoding.EncodeToString(data))
+	case utf8.Valid(data):
+		writeString(&c.buf, string(data))
+	default:
+		c.buf.WriteString(`{"$binary":`)
+		writeString(&c.buf, base64.StdEncoding.EncodeToString(data))
+		c.buf.WriteString("}")
+	}
+}
+
+func (c *converter) writeArray(elems []interface{}) error {
+	c.buf.WriteString("[")
+	for i, elem := range elems {
+		if i > 0 {
+			c.buf.WriteString(",")
+		}
+		if err := c.writeTerm(elem); err != nil {
+			return err
+		}
+	}
+	c.buf.WriteString("]")
+	return nil
+}
+
+func (c *converter) writeMap(m bertrpc.Map) error {
+	keys := make([]interface{}, len(m))
+	for i, entry := range m {
+		keys[i] = entry.Key
+	}
+	if names, ok := c.objectKeys(keys); ok {
+		return c.writeObject(names, func(i int) interface{} { return m[i].Value })
+	}
+
+	c.buf.WriteString(`{"$map":[`)
+	for i, entry := range m {
+		if i > 0 {
+			c.buf.WriteString(",")
+		}
+		if err := c.writeArray([]interface{}{entry.Key, entry.Value}); err != nil {
+			return err
+		}
+	}
+	c.buf.WriteString("]}")
+	return nil
+}
+
+// writeObject writes an object with the given keys. Values are returned by value,
+// from the key index.
+func (c *converter) writeObject(keys []string, value func(i int) interface{}) error {
+	c.buf.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			c.buf.WriteString(",")
+		}
+		writeString(&c.buf, key)
+		c.buf.WriteString(":")
+		if err := c.writeTerm(value(i)); err != nil {
+			return err
+		}
+	}
+	c.buf.WriteString("}")
+	return nil
+}
+
+// proplistKeys returns the keys of a list that can be written as an object,
+// when the Proplists option is set.
+func (c *converter) proplistKeys(list bertrpc.List) ([]string, bool) {
+	if !c.opts.Proplists || len(list) == 0 {
+		return nil, false
+	}
+	keys := make([]interface{}, len(list))
+	for i, elem := range list {
+		t, ok := elem.(bertrpc.Tuple)
+		if !ok || len(t.Elems) != 2 {
+			return nil, false
+		}
+		keys[i] = t.Elems[0]
+	}
+	return c.objectKeys(keys)
+}
+
+// objectKeys returns the terms as object keys. Keys must be text: UTF-8 binaries,
+// or atoms unless atoms are written as objects. They must be unique, and must not start
+// with $, which is used by the special objects.
+func (c *converter) objectKeys(terms []interface{}) ([]string, bool) {
+	keys := make([]string, len(terms))
+	seen := make(map[string]bool, len(terms))
+	for i, term := range terms {
+		var key string
+		switch t := term.(type) {
+		case []byte:
+			if !utf8.Valid(t) {
+				return nil, false
+			}
+			key = string(t)
+		case bertrpc.String:
+			if c.opts.Atoms == AtomObject || !utf8.ValidString(t.Value) {
+				return nil, false
+			}
+			key = t.Value
+		default:
+			return nil, false
+		}
+		if strings.HasPrefix(key, "$") || seen[key] {
+			return nil, false
+		}
+		seen[key] = true
+		keys[i] = key
+	}
+	return keys, true
+}
+
+// writeString writes a JSON string, without escaping HTML characters.
+func writeString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	// Remove the newline added by the encoder
+	buf.Truncate(buf.Len() - 1)
+}
+
+// writeFloat writes a float so that it is read back as a float, with a fraction or an exponent.
+func writeFloat(buf *bytes.Buffer, f float64) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	if !bytes.ContainsAny(data, ".eE") {
+		buf.WriteString(".0")
+	}
+	return nil
+}
+
+// ============================================================================
+// JSON to Erlang
+
+// object is a JSON object, keeping the order of its members.
+type object []member
+
+type member struct {
+	key   string
+	value interface{}
+}
+
+func (o object) get(key string) (interface{}, bool) {
+	for _, m := range o {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+	return nil, false
+}
+
+// readValue reads a JSON value from a decoder using numbers. Objects are returned
+// as object, arrays as []interface{} and other values as returned by the decoder.
+func readValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := readValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := dec.Token()
+		return array, err
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	}
+	return tok, nil
+}
+
+// specialKeys are the keys identifying objects that represent Erlang terms.
+var specialKeys = []string{"$atom", "$tuple", "$binary", "$bitstring", "$improper", "$map", "$etf"}
+
+// term converts a JSON value, as returned by readValue, to a generic term.
+func (c *converter) term(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return bertrpc.A("null"), nil
+	case bool:
+		return bertrpc.A(strconv.FormatBool(v)), nil
+	case json.Number:
+		return number(v)
+	case string:
+		if c.opts.Binaries == BinaryBase64 {
+			return base64.StdEncoding.DecodeString(v)
+		}
+		return []byte(v), nil
+	case []interface{}:
+		return c.terms(v)
+	case object:
+		for _, key := range specialKeys {
+			if special, ok := v.get(key); ok {
+				return c.specialTerm(key, special, v)
+			}
+		}
+		return c.objectTerm(v)
+	}
+	return nil, fmt.Errorf("unexpected JSON value %v", value)
+}
+
+func (c *converter) terms(values []interface{}) (bertrpc.List, error) {
+	list := make(bertrpc.List, len(values))
+	for i, value := range values {
+		var err error
+		if list[i], err = c.term(value); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// number converts a JSON number to an integer, or a float if it has a fraction or an exponent.
+func number(n json.Number) (interface{}, error) {
+	s := n.String()
+	if strings.ContainsAny(s, ".eE") {
+		return n.Float64()
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer %s", s)
+	}
+	return i, nil
+}
+
+// specialTerm converts an object identified by one of the special keys.
+func (c *converter) specialTerm(key string, value interface{}, obj object) (interface{}, error) {
+	invalid := fmt.Errorf("invalid %s object", key)
+	switch key {
+	case "$atom":
+		name, ok := value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		return bertrpc.A(name), nil
+	case "$tuple":
+		elems, ok := value.([]interface{})
+		if !ok {
+			return nil, invalid
+		}
+		list, err := c.terms(elems)
+		return bertrpc.Tuple{Elems: list}, err
+	case "$binary", "$etf":
+		s, ok := value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", invalid, err)
+		}
+		if key == "$etf" {
+			return bertrpc.RawTerm(data), nil
+		}
+		return data, nil
+	case "$bitstring":
+		s, ok := value.(string)
+		bits, hasBits := obj.get("bits")
+		n, isNumber := bits.(json.Number)
+		if !ok || !hasBits || !isNumber {
+			return nil, invalid
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", invalid, err)
+		}
+		b, err := strconv.ParseUint(n.String(), 10, 8)
+		if err != nil || b < 1 || b > 8 {
+			return nil, fmt.Errorf("%s: bits must be between 1 and 8", invalid)
+		}
+		return bertrpc.BitString{Bytes: data, Bits: uint8(b)}, nil
+	case "$improper":
+		elems, ok := value.([]interface{})
+		tail, hasTail := obj.get("tail")
+		if !ok || !hasTail {
+			return nil, invalid
+		}
+		list, err := c.terms(elems)
+		if err != nil {
+			return nil, err
+		}
+		t, err := c.term(tail)
+		return bertrpc.ImproperList{Elems: list, Tail: t}, err
+	case "$map":
+		entries, ok := value.([]interface{})
+		if !ok {
+			return nil, invalid
+		}
+		m := make(bertrpc.Map, len(entries))
+		for i, entry := range entries {
+			pair, ok := entry.([]interface{})
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("%s: entries must be [key, value] arrays", invalid)
+			}
+			kv, err := c.terms(pair)
+			if err != nil {
+				return nil, err
+			}
+			m[i] = bertrpc.MapEntry{Key: kv[0], Value: kv[1]}
+		}
+		return m, nil
+	}
+	return nil, invalid
+}
+
+// objectTerm converts an object to a map, or a proplist, with binary keys.
+func (c *converter) objectTerm(obj object) (interface{}, error) {
+	m := make(bertrpc.Map, len(obj))
+	for i, member := range obj {
+		value, err := c.term(member.value)
+		if err != nil {
+			return nil, err
+		}
+		m[i] = bertrpc.MapEntry{Key: []byte(member.key), Value: value}
+	}
+	if !c.opts.Proplists {
+		return m, nil
+	}
+	list := make(bertrpc.List, len(m))
+	for i, entry := range m {
+		list[i] = bertrpc.T(entry.Key, entry.Value)
+	}
+	return list, nil
+}
@@ -0,0 +1,181 @@
+package etfjson_test // import "gosrc.io/erlang/etfjson_test"
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+	"gosrc.io/erlang/etfjson"
+)
+
+func TestToJSON(t *testing.T) {
+	bigInt, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	pid := bertrpc.Pid{Node: "a@b", ID: 1, Serial: 2, Creation: 3}
+	var tests = []struct {
+		term     interface{}
+		opts     etfjson.Options
+		expected string
+	}{
+		{42, etfjson.Options{}, `42`},
+		{bigInt, etfjson.Options{}, `123456789012345678901234567890`},
+		{1.0, etfjson.Options{}, `1.0`},
+		{1.5e-7, etfjson.Options{}, `1.5e-7`},
+		{bertrpc.A("true"), etfjson.Options{}, `true`},
+		{bertrpc.A("null"), etfjson.Options{}, `null`},
+		{bertrpc.A("ok"), etfjson.Options{}, `"ok"`},
+		{bertrpc.A("ok"), etfjson.Options{Atoms: etfjson.AtomObject}, `{"$atom":"ok"}`},
+		{[]byte("<été>"), etfjson.Options{}, `"<été>"`},
+		{[]byte{0xFF, 0}, etfjson.Options{}, `{"$binary":"/wA="}`},
+		{[]byte("abc"), etfjson.Options{Binaries: etfjson.BinaryBase64}, `"YWJj"`},
+		{bertrpc.BitString{Bytes: []byte{0xF0}, Bits: 4}, etfjson.Options{}, `{"$bitstring":"8A==","bits":4}`},
+		{bertrpc.T(bertrpc.A("ok"), 1), etfjson.Options{}, `["ok",1]`},
+		{bertrpc.T(bertrpc.A("ok"), 1), etfjson.Options{Tuples: etfjson.TupleObject}, `{"$tuple":["ok",1]}`},
+		{bertrpc.List{}, etfjson.Options{}, `[]`},
+		{bertrpc.ImproperList{Elems: []interface{}{1}, Tail: 2}, etfjson.Options{}, `{"$improper":[1],"tail":2}`},
+		{
+			bertrpc.List{bertrpc.T(bertrpc.A("a"), 1), bertrpc.T([]byte("b"), 2)},
+			etfjson.Options{},
+			`[["a",1],["b",2]]`,
+		},
+		{
+			bertrpc.List{bertrpc.T(bertrpc.A("a"), 1), bertrpc.T([]byte("b"), 2)},
+			etfjson.Options{Proplists: true},
+			`{"a":1,"b":2}`,
+		},
+		{
+			bertrpc.List{bertrpc.T(bertrpc.A("a"), 1), bertrpc.T(bertrpc.A("a"), 2)},
+			etfjson.Options{Proplists: true},
+			`[["a",1],["a",2]]`,
+		},
+		{
+			bertrpc.Map{{Key: bertrpc.A("b"), Value: 1}, {Key: []byte("a"), Value: bertrpc.List{}}},
+			etfjson.Options{},
+			`{"b":1,"a":[]}`,
+		},
+		{
+			bertrpc.Map{{Key: bertrpc.A("b"), Value: 1}},
+			etfjson.Options{Atoms: etfjson.AtomObject},
+			`{"$map":[[{"$atom":"b"},1]]}`,
+		},
+		{bertrpc.Map{{Key: 1, Value: 2}}, etfjson.Options{}, `{"$map":[[1,2]]}`},
+		{bertrpc.Map{{Key: []byte("$atom"), Value: 2}}, etfjson.Options{}, `{"$map":[["$atom",2]]}`},
+		{pid, etfjson.Options{}, `{"$etf":"g1h3A2FAYgAAAAEAAAACAAAAAw=="}`},
+	}
+
+	for _, tt := range tests {
+		data, err := bertrpc.Encode(tt.term)
+		if err != nil {
+			t.Errorf("cannot encode %v: %s", tt.term, err)
+			continue
+		}
+		actual, err := etfjson.ToJSON(data, tt.opts)
+		if err != nil {
+			t.Errorf("cannot convert %v to JSON: %s", tt.term, err)
+			continue
+		}
+		if string(actual) != tt.expected {
+			t.Errorf("converting %v to JSON: expected %s, actual %s", tt.term, tt.expected, actual)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	bigInt, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	var tests = []struct {
+		json     string
+		opts     etfjson.Options
+		expected interface{}
+	}{
+		{`42`, etfjson.Options{}, 42},
+		{`123456789012345678901234567890`, etfjson.Options{}, bigInt},
+		{`1.0`, etfjson.Options{}, 1.0},
+		{`2e3`, etfjson.Options{}, 2000.0},
+		{`[true, false, null]`, etfjson.Options{}, bertrpc.List{bertrpc.A("true"), bertrpc.A("false"), bertrpc.A("null")}},
+		{`"été"`, etfjson.Options{}, []byte("été")},
+		{`"YWJj"`, etfjson.Options{Binaries: etfjson.BinaryBase64}, []byte("abc")},
+		{`{"$atom": "ok"}`, etfjson.Options{}, bertrpc.A("ok")},
+		{`{"$binary": "/wA="}`, etfjson.Options{}, []byte{0xFF, 0}},
+		{`{"bits": 4, "$bitstring": "8A=="}`, etfjson.Options{}, bertrpc.BitString{Bytes: []byte{0xF0}, Bits: 4}},
+		{`{"$tuple": [{"$atom": "ok"}, 1]}`, etfjson.Options{}, bertrpc.T(bertrpc.A("ok"), 1)},
+		{`{"$improper": [1], "tail": 2}`, etfjson.Options{}, bertrpc.ImproperList{Elems: []interface{}{1}, Tail: 2}},
+		{`{"$map": [[1, 2]]}`, etfjson.Options{}, bertrpc.Map{{Key: 1, Value: 2}}},
+		{`{"b": 1, "a": []}`, etfjson.Options{}, bertrpc.Map{{Key: []byte("b"), Value: 1}, {Key: []byte("a"), Value: bertrpc.List{}}}},
+		{`{"b": 1}`, etfjson.Options{Proplists: true}, bertrpc.List{bertrpc.T([]byte("b"), 1)}},
+		{`{"$etf": "g1h3A2FAYgAAAAEAAAACAAAAAw=="}`, etfjson.Options{}, bertrpc.Pid{Node: "a@b", ID: 1, Serial: 2, Creation: 3}},
+	}
+
+	for _, tt := range tests {
+		expected, err := bertrpc.Encode(tt.expected)
+		if err != nil {
+			t.Errorf("cannot encode %v: %s", tt.expected, err)
+			continue
+		}
+		actual, err := etfjson.FromJSON([]byte(tt.json), tt.opts)
+		if err != nil {
+			t.Errorf("cannot convert %s from JSON: %s", tt.json, err)
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("converting %s from JSON: expected %v, actual %v", tt.json, expected, actual)
+		}
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	var tests = []string{
+		`[1,`,
+		`1 2`,
+		`{"$atom": 1}`,
+		`{"$binary": "not base64"}`,
+		`{"$bitstring": "8A==", "bits": 9}`,
+		`{"$improper": [1]}`,
+		`{"$map": [[1]]}`,
+		`{"$etf": "AAAA"}`,
+	}
+
+	for _, text := range tests {
+		if _, err := etfjson.FromJSON([]byte(text), etfjson.Options{}); err == nil {
+			t.Errorf("converting %s from JSON should fail", text)
+		}
+	}
+}
+
+// Terms without ambiguities survive a round trip with object representations.
+func TestJSONRoundTrip(t *testing.T) {
+	term := bertrpc.Map{
+		{Key: []byte("status"), Value: bertrpc.T(bertrpc.A("ok"), []byte("done"))},
+		{Key: []byte("values"), Value: bertrpc.List{1, 2.5, bertrpc.A("true"), []byte{0xFF}}},
+		{Key: bertrpc.A("key"), Value: bertrpc.Map{}},
+	}
+	data, err := bertrpc.Encode(term)
+	if err != nil {
+		t.Fatalf("cannot encode term: %s", err)
+	}
+	opts := etfjson.Options{Atoms: etfjson.AtomObject, Tuples: etfjson.TupleObject}
+	text, err := etfjson.ToJSON(data, opts)
+	if err != nil {
+		t.Fatalf("cannot convert to JSON: %s", err)
+	}
+	actual, err := etfjson.FromJSON(text, opts)
+	if err != nil {
+		t.Fatalf("cannot convert from JSON %s: %s", text, err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Errorf("round trip through %s: expected %v, actual %v", text, data, actual)
+	}
+}
+
+func TestToJSONLimits(t *testing.T) {
+	data, err := bertrpc.Encode(bertrpc.List{1, 2, 3})
+	if err != nil {
+		t.Fatalf("cannot encode term: %s", err)
+	}
+	limits := bertrpc.DecodeLimits{MaxElements: 2}
+	for _, lossless := range []bool{false, true} {
+		_, err := etfjson.ToJSON(data, etfjson.Options{Lossless: lossless, Limits: limits})
+		if _, ok := err.(*bertrpc.LimitError); !ok {
+			t.Errorf("expected a LimitError in lossless mode %v, got %v", lossless, err)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package etfjson // import "gosrc.io/erlang/etfjson"
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gosrc.io/erlang/bertrpc"
+)
+
+// tagNames are the names of the ETF tags in the lossless representation.
+var tagNames = map[byte]string{
+	bertrpc.TagNewFloat:       "new_float",
+	bertrpc.TagBitBinary:      "bit_binary",
+	bertrpc.TagNewPid:         "new_pid",
+	bertrpc.TagNewPort:        "new_port",
+	bertrpc.TagNewerReference: "newer_reference",
+	bertrpc.TagSmallInteger:   "small_integer",
+	bertrpc.TagInteger:        "integer",
+	bertrpc.TagFloat:          "float",
+	bertrpc.TagDeprecatedAtom: "atom",
+	bertrpc.TagReference:      "reference",
+	bertrpc.TagPort:           "port",
+	bertrpc.TagPid:            "pid",
+	bertrpc.TagSmallTuple:     "small_tuple",
+	bertrpc.TagLargeTuple:     "large_tuple",
+	bertrpc.TagNil:            "nil",
+	bertrpc.TagString:         "string",
+	bertrpc.TagList:           "list",
+	bertrpc.TagBinary:         "binary",
+	bertrpc.TagSmallBig:       "small_big",
+	bertrpc.TagLargeBig:       "large_big",
+	bertrpc.TagNewFun:         "new_fun",
+	bertrpc.TagExport:         "export",
+	bertrpc.TagNewReference:   "new_reference",
+	bertrpc.TagMap:            "map",
+	bertrpc.TagAtomUTF8:       "atom_utf8",
+	bertrpc.TagSmallAtomUTF8:  "small_atom_utf8",
+	bertrpc.TagV4Port:         "v4_port",
+}
+
+var tagsByName = make(map[string]byte, len(tagNames))
+
+func init() {
+	for tag, name := range tagNames {
+		tagsByName[name] = tag
+	}
+}
+
+// field is the type of a field of a term with a fixed layout.
+type field int
+
+const (
+	fieldTerm field = iota
+	fieldUint8
+	fieldInt32
+	fieldUint32
+	fieldUint64
+)
+
+// fieldSizes are the sizes in bytes of the integer fields.
+var fieldSizes = map[field]int{fieldUint8: 1, fieldInt32: 4, fieldUint32: 4, fieldUint64: 8}
+
+// fixedLayouts are the fields of the terms written as a sequence of fields.
+var fixedLayouts = map[byte][]field{
+	bertrpc.TagSmallInteger: {fieldUint8},
+	bertrpc.TagInteger:      {fieldInt32},
+	bertrpc.TagPid:          {fieldTerm, fieldUint32, fieldUint32, fieldUint8},
+	bertrpc.TagNewPid:       {fieldTerm, fieldUint32, fieldUint32, fieldUint32},
+	bertrpc.TagPort:         {fieldTerm, fieldUint32, fieldUint8},
+	bertrpc.TagNewPort:      {fieldTerm, fieldUint32, fieldUint32},
+	bertrpc.TagV4Port:       {fieldTerm, fieldUint64, fieldUint32},
+	bertrpc.TagReference:    {fieldTerm, fieldUint32, fieldUint8},
+	bertrpc.TagExport:       {fieldTerm, fieldTerm, fieldTerm},
+}
+
+// floatSize is the size of the text of a FLOAT_EXT term.
+const floatSize = 31
+
+func losslessToJSON(data []byte, opts Options) ([]byte, error) {
+	var w losslessWriter
+	compressed := len(data) > 1 && data[1] == bertrpc.TagCompressed
+	if compressed {
+		w.buf.WriteString(`["compressed",`)
+	}
+	if err := bertrpc.Walk(data, &w, bertrpc.DecodeOptions{Limits: opts.Limits}); err != nil {
+		return nil, err
+	}
+	if compressed {
+		w.buf.WriteString("]")
+	}
+	return w.buf.Bytes(), nil
+}
+
+// losslessWriter writes the lossless representation of a term, as it is walked
+// by bertrpc. Each part of a term is preceded by a comma, except the lengths and
+// counts that are implied by the JSON arrays.
+type losslessWriter struct {
+	buf bytes.Buffer
+	// terms are the terms being written, innermost last.
+	terms []losslessTerm
+}
+
+// losslessTerm is a term being written.
+type losslessTerm struct {
+	tag byte
+	// parts is the number of parts of the term walked so far, including nested terms.
+	parts int
+	// count is the number of elements of lists and maps, and of IDs of references.
+	count uint64
+	// size and sign of big integers, written after their digits.
+	size, sign uint64
+}
+
+// next returns the term being written, and the index of its next part.
+func (w *losslessWriter) next() (*losslessTerm, int) {
+	t := &w.terms[len(w.terms)-1]
+	t.parts++
+	return t, t.parts - 1
+}
+
+func (w *losslessWriter) BeginTerm(tag byte) error {
+	name, ok := tagNames[tag]
+	if !ok {
+		return fmt.Errorf("unsupported tag %d", tag)
+	}
+	if len(w.terms) > 0 {
+		t, i := w.next()
+		switch t.tag {
+		case bertrpc.TagList:
+			// Elements are written in an array, followed by the tail
+			if uint64(i) > t.count {
+				w.buf.WriteString("],")
+			} else if i > 1 {
+				w.buf.WriteString(",")
+			}
+		case bertrpc.TagMap:
+			// Keys and values are written in [key, value] arrays
+			switch {
+			case i%2 == 0:
+				w.buf.WriteString(",")
+			case i > 1:
+				w.buf.WriteString("],[")
+			default:
+				w.buf.WriteString("[")
+			}
+		default:
+			w.buf.WriteString(",")
+		}
+	}
+	w.terms = append(w.terms, losslessTerm{tag: tag})
+	w.buf.WriteString("[")
+	writeString(&w.buf, name)
+	return nil
+}
+
+func (w *losslessWriter) EndTerm(tag byte) error {
+	t := w.terms[len(w.terms)-1]
+	w.terms = w.terms[:len(w.terms)-1]
+	switch tag {
+	case bertrpc.TagMap:
+		if t.count > 0 {
+			w.buf.WriteString("]")
+		}
+		w.buf.WriteString("]")
+	case bertrpc.TagNewReference, bertrpc.TagNewerReference:
+		if t.count == 0 {
+			w.buf.WriteString(",[")
+		}
+		w.buf.WriteString("]")
+	}
+	w.buf.WriteString("]")
+	return nil
+}
+
+func (w *losslessWriter) Uint(u uint64, size int) error {
+	t, i := w.next()
+	switch t.tag {
+	case bertrpc.TagInteger:
+		w.buf.WriteString(",")
+		w.buf.WriteString(strconv.FormatInt(int64(int32(u)), 10))
+		return nil
+	case bertrpc.TagNewFloat:
+		w.buf.WriteString(",")
+		return writeFloat(&w.buf, math.Float64frombits(u))
+
+	case bertrpc.TagSmallBig, bertrpc.TagLargeBig:
+		// The number of digits is kept, as they can be padded with zeros
+		if i == 0 {
+			t.size = u
+		} else {
+			t.sign = u
+		}
+		return nil
+	case bertrpc.TagBitBinary:
+		if i == 0 {
+			return nil
+		}
+	case bertrpc.TagDeprecatedAtom, bertrpc.TagAtomUTF8, bertrpc.TagSmallAtomUTF8, bertrpc.TagString,
+		bertrpc.TagBinary, bertrpc.TagNewFun, bertrpc.TagSmallTuple, bertrpc.TagLargeTuple:
+		return nil
+
+	case bertrpc.TagList, bertrpc.TagMap:
+		t.count = u
+		w.buf.WriteString(",[")
+		return nil
+	case bertrpc.TagNewReference, bertrpc.TagNewerReference:
+		// Count, node, creation, and IDs written in an array
+		switch {
+		case i == 0:
+			t.count = u
+			return nil
+		case i == 3:
+			w.buf.WriteString(",[")
+		default:
+			w.buf.WriteString(",")
+		}
+		w.buf.WriteString(strconv.FormatUint(u, 10))
+		return nil
+	}
+	w.buf.WriteString(",")
+	w.buf.WriteString(strconv.FormatUint(u, 10))
+	return nil
+}
+
+func (w *losslessWriter) Bytes(data []byte) error {
+	t, _ := w.next()
+	w.buf.WriteString(",")
+	switch t.tag {
+	case bertrpc.TagFloat:
+		// The text is padded with zeros, which are added back when converting from JSON
+		writeString(&w.buf, latin1(bytes.TrimRight(data, "\x00")))
+	case bertrpc.TagSmallBig, bertrpc.TagLargeBig:
+		s := new(big.Int).SetBytes(reverse(data)).String()
+		if t.sign != 0 {
+			s = "-" + s
+		}
+		writeString(&w.buf, s)
+		fmt.Fprintf(&w.buf, ",%d", t.size)
+	case bertrpc.TagDeprecatedAtom, bertrpc.TagString:
+		writeString(&w.buf, latin1(data))
+	case bertrpc.TagAtomUTF8, bertrpc.TagSmallAtomUTF8:
+		if !utf8.Valid(data) {
+			return fmt.Errorf("atom %q is not valid UTF-8", data)
+		}
+		writeString(&w.buf, string(data))
+	default:
+		// Binaries, bitstrings and funs, which are kept as is after their size
+		writeString(&w.buf, base64.StdEncoding.EncodeToString(data))
+	}
+	return nil
+}
+
+// latin1 converts Latin-1 text to a string. Each byte is a character.
+func latin1(text []byte) string {
+	runes := make([]rune, len(text))
+	for i, b := range text {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// reverse returns the bytes in reverse order, to convert little endian digits to big endian.
+func reverse(data []byte) []byte {
+	r := make([]byte, len(data))
+	for i, b := range data {
+		r[len(data)-1-i] = b
+	}
+	return r
+}
+
+// ============================================================================
+// Lossless JSON to Erlang
+
+func losslessFromJSON(value interface{}) ([]byte, error) {
+	r := losslessReader{}
+	r.buf.WriteByte(bertrpc.TagETFVersion)
+	if array, ok := value.([]interface{}); ok && len(array) == 2 && array[0] == "compressed" {
+		var payload losslessReader
+		if err := payload.readTerm(array[1]); err != nil {
+			return nil, err
+		}
+		r.buf.WriteByte(bertrpc.TagCompressed)
+		r.writeUint(uint64(payload.buf.Len()), 4)
+		zw := zlib.NewWriter(&r.buf)
+		if _, err := zw.Write(payload.buf.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return r.buf.Bytes(), nil
+	}
+
+	if err := r.readTerm(value); err != nil {
+		return nil, err
+	}
+	return r.buf.Bytes(), nil
+}
+
+// losslessReader reads the lossless representation of a term, as decoded by
+// encoding/json with numbers, and writes its encoding.
+type losslessReader struct {
+	buf bytes.Buffer
+}
+
+func (r *losslessReader) writeUint(u uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		r.buf.WriteByte(byte(u >> (8 * uint(i))))
+	}
+}
+
+func (r *losslessReader) readTerm(value interface{}) error {
+	array, ok := value.([]interface{})
+	if !ok || len(array) == 0 {
+		return fmt.Errorf("expected a term array, found %v", value)
+	}
+	name, _ := array[0].(string)
+	tag, ok := tagsByName[name]
+	if !ok {
+		return fmt.Errorf("unknown term type %v", array[0])
+	}
+	r.buf.WriteByte(tag)
+	if err := r.readContent(tag, array[1:]); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// readContent reads the content of a term, from the values following its name.
+func (r *losslessReader) readContent(tag byte, values []interface{}) error {
+	if layout, ok := fixedLayouts[tag]; ok {
+		if len(values) != len(layout) {
+			return fmt.Errorf("expected %d values, found %d", len(layout), len(values))
+		}
+		for i, f := range layout {
+			if err := r.readField(f, values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	expect := func(n int) error {
+		if len(values) != n {
+			return fmt.Errorf("expected %d values, found %d", n, len(values))
+		}
+		return nil
+	}
+
+	switch tag {
+	case bertrpc.TagNil:
+		return expect(0)
+
+	case bertrpc.TagNewFloat:
+		if err := expect(1); err != nil {
+			return err
+		}
+		n, ok := values[0].(json.Number)
+		if !ok {
+			return fmt.Errorf("expected a number, found %v", values[0])
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		r.writeUint(math.Float64bits(f), 8)
+	case bertrpc.TagFloat:
+		if err := expect(1); err != nil {
+			return err
+		}
+		text, err := latin1Value(values[0])
+		if err != nil {
+			return err
+		}
+		if len(text) > floatSize {
+			return fmt.Errorf("text longer than %d characters", floatSize)
+		}
+		r.buf.Write(text)
+		r.buf.Write(make([]byte, floatSize-len(text)))
+
+	case bertrpc.TagSmallBig, bertrpc.TagLargeBig:
+		if err := expect(2); err != nil {
+			return err
+		}
+		s, ok := values[0].(string)
+		if !ok {
+			return fmt.Errorf("expected a string, found %v", values[0])
+		}
+		size, max := 1, uint64(math.MaxUint8)
+		if tag == bertrpc.TagLargeBig {
+			size, max = 4, math.MaxUint32
+		}
+		n, err := uintValue(values[1], max)
+		if err != nil {
+			return err
+		}
+		sign := byte(0)
+		if strings.HasPrefix(s, "-") {
+			sign, s = 1, s[1:]
+		}
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok || i.Sign() < 0 {
+			return fmt.Errorf("invalid integer %q", values[0])
+		}
+		digits := reverse(i.Bytes())
+		if uint64(len(digits)) > n {
+			return fmt.Errorf("integer does not fit in %d bytes", n)
+		}
+		r.writeUint(n, size)
+		r.buf.WriteByte(sign)
+		r.buf.Write(digits)
+		r.buf.Write(make([]byte, int(n)-len(digits)))
+
+	case bertrpc.TagDeprecatedAtom, bertrpc.TagAtomUTF8, bertrpc.TagSmallAtomUTF8, bertrpc.TagString:
+		if err := expect(1); err != nil {
+			return err
+		}
+		var text []byte
+		if tag == bertrpc.TagDeprecatedAtom || tag == bertrpc.TagString {
+			var err error
+			if text, err = latin1Value(values[0]); err != nil {
+				return err
+			}
+		} else {
+			s, ok := values[0].(string)
+			if !ok {
+				return fmt.Errorf("expected a string, found %v", values[0])
+			}
+			text = []byte(s)
+		}
+		size, max := 2, math.MaxUint16
+		if tag == bertrpc.TagSmallAtomUTF8 {
+			size, max = 1, math.MaxUint8
+		}
+		if len(text) > max {
+			return fmt.Errorf("text longer than %d bytes", max)
+		}
+		r.writeUint(uint64(len(text)), size)
+		r.buf.Write(text)
+
+	case bertrpc.TagBinary:
+		if err := expect(1); err != nil {
+			return err
+		}
+		data, err := bytesValue(values[0])
+		if err != nil {
+			return err
+		}
+		r.writeUint(uint64(len(data)), 4)
+		r.buf.Write(data)
+	case bertrpc.TagBitBinary:
+		if err := expect(2); err != nil {
+			return err
+		}
+		bits, err := uintValue(values[0], math.MaxUint8)
+		if err != nil {
+			return err
+		}
+		data, err := bytesValue(values[1])
+		if err != nil {
+			return err
+		}
+		r.writeUint(uint64(len(data)), 4)
+		r.buf.WriteByte(byte(bits))
+		r.buf.Write(data)
+	case bertrpc.TagNewFun:
+		if err := expect(1); err != nil {
+			return err
+		}
+		data, err := bytesValue(values[0])
+		if err != nil {
+			return err
+		}
+		r.writeUint(uint64(len(data)+4), 4)
+		r.buf.Write(data)
+
+	case bertrpc.TagSmallTuple, bertrpc.TagLargeTuple:
+		size, max := 1, math.MaxUint8
+		if tag == bertrpc.TagLargeTuple {
+			size, max = 4, math.MaxUint32
+		}
+		if len(values) > max {
+			return fmt.Errorf("more than %d elements", max)
+		}
+		r.writeUint(uint64(len(values)), size)
+		for _, value := range values {
+			if err := r.readTerm(value); err != nil {
+				return err
+			}
+		}
+	case bertrpc.TagList:
+		if err := expect(2); err != nil {
+			return err
+		}
+		elems, ok := values[0].([]interface{})
+		if !ok {
+			return fmt.Errorf("expected an array of elements, found %v", values[0])
+		}
+		r.writeUint(uint64(len(elems)), 4)
+		for _, elem := range elems {
+			if err := r.readTerm(elem); err != nil {
+				return err
+			}
+		}
+		return r.readTerm(values[1])
+	case bertrpc.TagMap:
+		if err := expect(1); err != nil {
+			return err
+		}
+		entries, ok := values[0].([]interface{})
+		if !ok {
+			return fmt.Errorf("expected an array of entries, found %v", values[0])
+		}
+		r.writeUint(uint64(len(entries)), 4)
+		for _, entry := range entries {
+			pair, ok := entry.([]interface{})
+			if !ok || len(pair) != 2 {
+				return fmt.Errorf("entries must be [key, value] arrays, found %v", entry)
+			}
+			for _, term := range pair {
+				if err := r.readTerm(term); err != nil {
+					return err
+				}
+			}
+		}
+
+	case bertrpc.TagNewReference, bertrpc.TagNewerReference:
+		if err := expect(3); err != nil {
+			return err
+		}
+		ids, ok := values[2].([]interface{})
+		if !ok || len(ids) > math.MaxUint16 {
+			return fmt.Errorf("expected an array of IDs, found %v", values[2])
+		}
+		r.writeUint(uint64(len(ids)), 2)
+		if err := r.readTerm(values[0]); err != nil {
+			return err
+		}
+		creation := fieldUint8
+		if tag == bertrpc.TagNewerReference {
+			creation = fieldUint32
+		}
+		if err := r.readField(creation, values[1]); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := r.readField(fieldUint32, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *losslessReader) readField(f field, value interface{}) error {
+	switch f {
+	case fieldTerm:
+		return r.readTerm(value)
+	case fieldInt32:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("expected a number, found %v", value)
+		}
+		i, err := strconv.ParseInt(n.String(), 10, 32)
+		if err != nil {
+			return err
+		}
+		r.writeUint(uint64(uint32(i)), 4)
+		return nil
+	}
+
+	size := fieldSizes[f]
+	u, err := uintValue(value, math.MaxUint64>>(64-8*uint(size)))
+	if err != nil {
+		return err
+	}
+	r.writeUint(u, size)
+	return nil
+}
+
+// uintValue returns a JSON number as an unsigned integer, up to max.
+func uintValue(value interface{}, max uint64) (uint64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, found %v", value)
+	}
+	u, err := strconv.ParseUint(n.String(), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if u > max {
+		return 0, fmt.Errorf("%d is greater than %d", u, max)
+	}
+	return u, nil
+}
+
+// bytesValue returns the bytes of a base64 JSON string.
+func bytesValue(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a base64 string, found %v", value)
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// latin1Value returns the Latin-1 encoding of a JSON string.
+func latin1Value(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string, found %v", value)
+	}
+	text := make([]byte, 0, len(s))
+	for _, c := range s {
+		if c > 0xFF {
+			return nil, fmt.Errorf("character %q is not Latin-1", c)
+		}
+		text = append(text, byte(c))
+	}
+	return text, nil
+}
@@ -0,0 +1,129 @@
+package etfjson_test // import "gosrc.io/erlang/etfjson_test"
+
+import (
+	"bytes"
+	"testing"
+
+	"gosrc.io/erlang/bertrpc"
+	"gosrc.io/erlang/etfjson"
+)
+
+var lossless = etfjson.Options{Lossless: true}
+
+func TestLosslessToJSON(t *testing.T) {
+	var tests = []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{131, 97, 42}, `["small_integer",42]`},
+		// An integer that could use SMALL_INTEGER_EXT
+		{[]byte{131, 98, 0, 0, 0, 42}, `["integer",42]`},
+		{[]byte{131, 98, 255, 255, 255, 214}, `["integer",-42]`},
+		// A big integer padded with zeros
+		{[]byte{131, 110, 3, 1, 42, 0, 0}, `["small_big","-42",3]`},
+		{[]byte{131, 70, 63, 248, 0, 0, 0, 0, 0, 0}, `["new_float",1.5]`},
+		{append([]byte{131, 99}, []byte("1.50000000000000000000e+00\x00\x00\x00\x00\x00")...), `["float","1.50000000000000000000e+00"]`},
+		{[]byte{131, 100, 0, 2, 'o', 'k'}, `["atom","ok"]`},
+		{[]byte{131, 100, 0, 1, 0xE9}, `["atom","é"]`},
+		{[]byte{131, 119, 2, 'o', 'k'}, `["small_atom_utf8","ok"]`},
+		{[]byte{131, 107, 0, 2, 'h', 0xE9}, `["string","hé"]`},
+		{[]byte{131, 106}, `["nil"]`},
+		{[]byte{131, 108, 0, 0, 0, 1, 97, 1, 97, 2}, `["list",[["small_integer",1]],["small_integer",2]]`},
+		{[]byte{131, 108, 0, 0, 0, 2, 97, 1, 106, 106}, `["list",[["small_integer",1],["nil"]],["nil"]]`},
+		// A list with no elements, that could use NIL_EXT
+		{[]byte{131, 108, 0, 0, 0, 0, 106}, `["list",[],["nil"]]`},
+		// A tuple that could use SMALL_TUPLE_EXT
+		{[]byte{131, 105, 0, 0, 0, 1, 106}, `["large_tuple",["nil"]]`},
+		{[]byte{131, 109, 0, 0, 0, 2, 1, 2}, `["binary","AQI="]`},
+		{[]byte{131, 77, 0, 0, 0, 1, 4, 0xF0}, `["bit_binary",4,"8A=="]`},
+		{[]byte{131, 116, 0, 0, 0, 1, 97, 1, 106}, `["map",[[["small_integer",1],["nil"]]]]`},
+		{[]byte{131, 116, 0, 0, 0, 2, 97, 1, 106, 97, 2, 106}, `["map",[[["small_integer",1],["nil"]],[["small_integer",2],["nil"]]]]`},
+		{[]byte{131, 116, 0, 0, 0, 0}, `["map",[]]`},
+		{[]byte{131, 88, 119, 1, 'a', 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, `["new_pid",["small_atom_utf8","a"],1,2,3]`},
+		{[]byte{131, 90, 0, 2, 119, 1, 'a', 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 2}, `["newer_reference",["small_atom_utf8","a"],3,[1,2]]`},
+		{[]byte{131, 90, 0, 0, 119, 1, 'a', 0, 0, 0, 3}, `["newer_reference",["small_atom_utf8","a"],3,[]]`},
+		{[]byte{131, 113, 119, 1, 'm', 119, 1, 'f', 97, 1}, `["export",["small_atom_utf8","m"],["small_atom_utf8","f"],["small_integer",1]]`},
+	}
+
+	for _, tt := range tests {
+		actual, err := etfjson.ToJSON(tt.data, lossless)
+		if err != nil {
+			t.Errorf("cannot convert %v to JSON: %s", tt.data, err)
+			continue
+		}
+		if string(actual) != tt.expected {
+			t.Errorf("converting %v to JSON: expected %s, actual %s", tt.data, tt.expected, actual)
+		}
+
+		// Converting back gives the original encoding
+		data, err := etfjson.FromJSON(actual, lossless)
+		if err != nil {
+			t.Errorf("cannot convert %s from JSON: %s", actual, err)
+			continue
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Errorf("converting %s from JSON: expected %v, actual %v", actual, tt.data, data)
+		}
+	}
+}
+
+func TestLosslessRoundTrip(t *testing.T) {
+	term := bertrpc.T(
+		bertrpc.A("reply"),
+		bertrpc.Map{{Key: []byte("id"), Value: int64(1) << 40}},
+		bertrpc.CharList{Value: "hello"},
+		bertrpc.Ref{Node: "a@b", Creation: 1, ID: []uint32{1, 2, 3}},
+		bertrpc.Port{Node: "a@b", ID: 1 << 40, Creation: 1},
+		bertrpc.ImproperList{Elems: []interface{}{1}, Tail: 2.5},
+		bytes.Repeat([]byte("data"), 100),
+	)
+	for _, level := range []int{0, 6} {
+		data, err := bertrpc.EncodeWithOptions(term, bertrpc.EncodeOptions{CompressionLevel: level})
+		if err != nil {
+			t.Fatalf("cannot encode term: %s", err)
+		}
+		if (level > 0) != (data[1] == bertrpc.TagCompressed) {
+			t.Fatalf("term should be compressed with level %d", level)
+		}
+		text, err := etfjson.ToJSON(data, lossless)
+		if err != nil {
+			t.Fatalf("cannot convert to JSON: %s", err)
+		}
+		actual, err := etfjson.FromJSON(text, lossless)
+		if err != nil {
+			t.Fatalf("cannot convert from JSON %s: %s", text, err)
+		}
+
+		// Compressed data can differ, so compare the decoded terms
+		var expected, decoded bertrpc.RawTerm
+		if err := bertrpc.Unmarshal(data, &expected); err != nil {
+			t.Fatalf("cannot decode term: %s", err)
+		}
+		if err := bertrpc.Unmarshal(actual, &decoded); err != nil {
+			t.Fatalf("cannot decode converted term: %s", err)
+		}
+		if !bytes.Equal(decoded, expected) || (data[1] == bertrpc.TagCompressed) != (actual[1] == bertrpc.TagCompressed) {
+			t.Errorf("round trip through %s: expected %v, actual %v", text, data, actual)
+		}
+	}
+}
+
+func TestLosslessFromJSONErrors(t *testing.T) {
+	var tests = []string{
+		`42`,
+		`["unknown"]`,
+		`["small_integer",256]`,
+		`["integer",2147483648]`,
+		`["small_big","256",1]`,
+		`["string","€"]`,
+		`["list",[]]`,
+		`["nil",1]`,
+		`["binary","not base64"]`,
+	}
+
+	for _, text := range tests {
+		if _, err := etfjson.FromJSON([]byte(text), lossless); err == nil {
+			t.Errorf("converting %s from JSON should fail", text)
+		}
+	}
+}
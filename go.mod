@@ -1,3 +1,3 @@
 module gosrc.io/erlang
 
-go 1.12
+go 1.13